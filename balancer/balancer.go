@@ -0,0 +1,175 @@
+package balancer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gomicro-discover/discover"
+	"sync"
+)
+
+//客户端负载均衡：基于discover.Client的订阅维护每个服务的实例列表，
+//选择实例时直接使用内存中的数据，不会每次都请求consul
+
+var ErrBalancerClosed = errors.New("balancer closed")
+
+//选择器在选择时已经没有实例（如实例列表刚被清空），与discover.ErrServiceNotFound匹配
+var ErrNoInstances = fmt.Errorf("%w: no instances to pick from", discover.ErrServiceNotFound)
+
+type Balancer struct {
+	client   discover.Client
+	strategy Strategy
+	filter   func(*discover.ServiceInstance) bool
+	ctx      context.Context
+	cancel   context.CancelFunc
+	mutex    sync.Mutex
+	services map[string]*serviceState
+}
+
+//单个服务的实例列表和选择器
+type serviceState struct {
+	ready     chan struct{} //收到第一个事件后关闭
+	readyOnce sync.Once
+	mutex     sync.RWMutex
+	picker    Picker
+	instances []*discover.ServiceInstance
+	err       error
+}
+
+type Option func(*Balancer)
+
+//选择实例时跳过filter返回false的实例（如被熔断驱逐的实例），
+//所有实例都被跳过时忽略filter，避免全部实例都不可用
+func WithFilter(filter func(*discover.ServiceInstance) bool) Option {
+	return func(b *Balancer) {
+		b.filter = filter
+	}
+}
+
+func New(client discover.Client, strategy Strategy, opts ...Option) *Balancer {
+	if strategy == nil {
+		strategy = RoundRobin()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	b := &Balancer{
+		client:   client,
+		strategy: strategy,
+		ctx:      ctx,
+		cancel:   cancel,
+		services: make(map[string]*serviceState),
+	}
+	for _, opt := range opts {
+		opt(b)
+	}
+	return b
+}
+
+//按负载均衡策略选择服务的一个可用实例，没有可用实例时返回discover.ErrServiceNotFound
+func (b *Balancer) Next(ctx context.Context, serviceName string) (*discover.ServiceInstance, error) {
+	state, err := b.state(serviceName)
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case <-state.ready:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-b.ctx.Done():
+		return nil, ErrBalancerClosed
+	}
+	state.mutex.RLock()
+	picker, count, err := state.picker, len(state.instances), state.err
+	state.mutex.RUnlock()
+	if count == 0 {
+		if err != nil {
+			return nil, err
+		}
+		return nil, discover.ErrServiceNotFound
+	}
+	first := picker.Pick()
+	if first == nil {
+		return nil, ErrNoInstances
+	}
+	if b.filter == nil || b.filter(first) {
+		return first, nil
+	}
+	//最多尝试实例数量次，仍然没有满足条件的实例时返回第一次选择的实例
+	for i := 1; i < count; i++ {
+		if instance := picker.Pick(); instance != nil && b.filter(instance) {
+			return instance, nil
+		}
+	}
+	return first, nil
+}
+
+//服务当前的实例列表
+func (b *Balancer) Instances(serviceName string) []*discover.ServiceInstance {
+	b.mutex.Lock()
+	state, ok := b.services[serviceName]
+	b.mutex.Unlock()
+	if !ok {
+		return nil
+	}
+	state.mutex.RLock()
+	defer state.mutex.RUnlock()
+	return state.instances
+}
+
+//停止所有订阅
+func (b *Balancer) Close() error {
+	b.cancel()
+	return nil
+}
+
+//获取服务的状态，第一次使用时订阅服务的变化
+func (b *Balancer) state(serviceName string) (*serviceState, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if err := b.ctx.Err(); err != nil {
+		return nil, ErrBalancerClosed
+	}
+	if state, ok := b.services[serviceName]; ok {
+		return state, nil
+	}
+	events, err := b.client.Subscribe(b.ctx, serviceName)
+	if err != nil {
+		return nil, err
+	}
+	state := &serviceState{ready: make(chan struct{})}
+	b.services[serviceName] = state
+	go b.watch(serviceName, state, events)
+	return state, nil
+}
+
+//根据订阅的事件更新选择器的实例列表，选择器不支持原地更新时重新创建，订阅结束后移除服务的状态，下次使用时重新订阅
+func (b *Balancer) watch(serviceName string, state *serviceState, events <-chan discover.Event) {
+	defer func() {
+		b.mutex.Lock()
+		if b.services[serviceName] == state {
+			delete(b.services, serviceName)
+		}
+		b.mutex.Unlock()
+		//没有收到任何事件时唤醒等待的调用方
+		state.mutex.Lock()
+		if state.picker == nil && state.err == nil {
+			state.err = discover.ErrClientClosed
+		}
+		state.mutex.Unlock()
+		state.readyOnce.Do(func() { close(state.ready) })
+	}()
+	for event := range events {
+		state.mutex.Lock()
+		state.err = event.Err
+		//出错时继续使用最近一次的实例列表
+		if event.Err == nil || len(event.Instances) > 0 {
+			state.instances = event.Instances
+			if updater, ok := state.picker.(Updater); ok {
+				updater.Update(event.Instances)
+			} else {
+				state.picker = b.strategy.Build(event.Instances)
+			}
+		}
+		state.mutex.Unlock()
+		state.readyOnce.Do(func() { close(state.ready) })
+	}
+}
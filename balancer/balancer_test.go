@@ -0,0 +1,219 @@
+package balancer_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gomicro-discover/balancer"
+	"gomicro-discover/discover"
+	"gomicro-discover/discover/discovertest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func instance(id string, passing int) *discover.ServiceInstance {
+	return &discover.ServiceInstance{ID: id, Address: "127.0.0.1", Status: discover.HealthPassing, Weights: discover.Weights{Passing: passing, Warning: 1}}
+}
+
+//依次选择n次，返回选中实例的ID
+func pick(picker balancer.Picker, n int) []string {
+	ids := make([]string, n)
+	for i := range ids {
+		ids[i] = picker.Pick().ID
+	}
+	return ids
+}
+
+func TestRoundRobin(t *testing.T) {
+	a, b, c := instance("a", 1), instance("b", 1), instance("c", 1)
+	picker := balancer.RoundRobin().Build([]*discover.ServiceInstance{a, b, c})
+	if got := strings.Join(pick(picker, 6), ","); got != "a,b,c,a,b,c" {
+		t.Fatalf("picks = %s, want a,b,c,a,b,c", got)
+	}
+	//更新后保留轮询位置
+	picker.(balancer.Updater).Update([]*discover.ServiceInstance{a, b, c, instance("d", 1)})
+	if got := strings.Join(pick(picker, 4), ","); got != "c,d,a,b" {
+		t.Fatalf("picks after update = %s, want c,d,a,b", got)
+	}
+	picker.(balancer.Updater).Update(nil)
+	if instance := picker.Pick(); instance != nil {
+		t.Fatalf("Pick() on empty list = %v, want nil", instance)
+	}
+}
+
+//平滑加权轮询：权重5,1,1时按a,a,b,a,c,a,a的顺序分散选择
+func TestWeightedRoundRobin(t *testing.T) {
+	a, b, c := instance("a", 5), instance("b", 1), instance("c", 1)
+	picker := balancer.WeightedRoundRobin().Build([]*discover.ServiceInstance{a, b, c})
+	if got := strings.Join(pick(picker, 7), ","); got != "a,a,b,a,c,a,a" {
+		t.Fatalf("picks = %s, want a,a,b,a,c,a,a", got)
+	}
+	//warning状态的实例使用Weights.Warning
+	warning := instance("a", 5)
+	warning.Status = discover.HealthWarning
+	picker.(balancer.Updater).Update([]*discover.ServiceInstance{warning, b, c})
+	counts := make(map[string]int)
+	for _, id := range pick(picker, 30) {
+		counts[id]++
+	}
+	if counts["a"] != 10 || counts["b"] != 10 || counts["c"] != 10 {
+		t.Fatalf("counts = %v, want 10 each", counts)
+	}
+}
+
+func TestRandom(t *testing.T) {
+	picker := balancer.Random().Build([]*discover.ServiceInstance{instance("a", 1), instance("b", 1), instance("c", 1)})
+	counts := make(map[string]int)
+	for _, id := range pick(picker, 3000) {
+		counts[id]++
+	}
+	for _, id := range []string{"a", "b", "c"} {
+		if counts[id] < 800 || counts[id] > 1200 {
+			t.Fatalf("counts = %v, want about 1000 each", counts)
+		}
+	}
+}
+
+//订阅client中的服务，等待第一次推送
+func newBalancer(t *testing.T, client discover.Client, opts ...balancer.Option) *balancer.Balancer {
+	t.Helper()
+	b := balancer.New(client, balancer.RoundRobin(), opts...)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := b.Next(ctx, "string"); err != nil {
+		t.Fatalf("Next() = %v", err)
+	}
+	return b
+}
+
+//跳过被过滤的实例，全部实例都被过滤时忽略filter
+func TestFilterFallback(t *testing.T) {
+	client := discovertest.NewClient()
+	defer client.Close()
+	client.SetInstances("string", instance("a", 1), instance("b", 1), instance("c", 1))
+	var (
+		mutex    sync.Mutex
+		rejected = map[string]bool{"b": true}
+	)
+	b := newBalancer(t, client, balancer.WithFilter(func(instance *discover.ServiceInstance) bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return !rejected[instance.ID]
+	}))
+	defer b.Close()
+	ctx := context.Background()
+	for i := 0; i < 10; i++ {
+		instance, err := b.Next(ctx, "string")
+		if err != nil {
+			t.Fatalf("Next() = %v", err)
+		}
+		if instance.ID == "b" {
+			t.Fatal("picked filtered instance b")
+		}
+	}
+
+	mutex.Lock()
+	rejected = map[string]bool{"a": true, "b": true, "c": true}
+	mutex.Unlock()
+	if instance, err := b.Next(ctx, "string"); err != nil || instance == nil {
+		t.Fatalf("Next() with every instance filtered = %v, %v, want an instance", instance, err)
+	}
+}
+
+func TestNextWithoutInstances(t *testing.T) {
+	client := discovertest.NewClient()
+	defer client.Close()
+	b := balancer.New(client, balancer.RoundRobin())
+	defer b.Close()
+	if _, err := b.Next(context.Background(), "string"); !errors.Is(err, discover.ErrServiceNotFound) {
+		t.Fatalf("Next() = %v, want ErrServiceNotFound", err)
+	}
+}
+
+//实例列表在空与非空之间频繁变化时并发选择，需要使用-race运行
+func TestConcurrentUpdateAndPick(t *testing.T) {
+	instances := []*discover.ServiceInstance{instance("a", 3), instance("b", 1)}
+	strategies := map[string]balancer.Strategy{
+		"round_robin": balancer.RoundRobin(),
+		"weighted":    balancer.WeightedRoundRobin(),
+		"random":      balancer.Random(),
+	}
+	for name, strategy := range strategies {
+		picker := strategy.Build(instances)
+		t.Run(name, func(t *testing.T) {
+			stress(t, func(i int) {
+				if i%2 == 0 {
+					picker.(balancer.Updater).Update(nil)
+				} else {
+					picker.(balancer.Updater).Update(instances)
+				}
+			}, func() error {
+				if instance := picker.Pick(); instance != nil && instance.ID != "a" && instance.ID != "b" {
+					return fmt.Errorf("picked unknown instance %s", instance.ID)
+				}
+				return nil
+			})
+		})
+	}
+
+	t.Run("balancer", func(t *testing.T) {
+		client := discovertest.NewClient()
+		defer client.Close()
+		client.SetInstances("string", instances...)
+		//filter会访问实例的字段，不能收到nil
+		b := newBalancer(t, client, balancer.WithFilter(func(instance *discover.ServiceInstance) bool {
+			return instance.ID != "b"
+		}))
+		defer b.Close()
+		stress(t, func(i int) {
+			if i%2 == 0 {
+				client.SetInstances("string")
+			} else {
+				client.SetInstances("string", instances...)
+			}
+		}, func() error {
+			_, err := b.Next(context.Background(), "string")
+			if err != nil && !errors.Is(err, discover.ErrServiceNotFound) {
+				return err
+			}
+			return nil
+		})
+	})
+}
+
+//在一段时间内不断调用update，同时多个goroutine调用pick
+func stress(t *testing.T, update func(i int), pick func() error) {
+	t.Helper()
+	done := make(chan struct{})
+	errs := make(chan error, 4)
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if err := pick(); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	deadline := time.Now().Add(200 * time.Millisecond)
+	for i := 0; time.Now().Before(deadline); i++ {
+		update(i)
+	}
+	close(done)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,161 @@
+package balancer
+
+import (
+	"gomicro-discover/discover"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//负载均衡策略，实例列表变化时实现了Updater的选择器原地更新实例列表，其余的选择器使用新的实例列表重新创建
+
+type Strategy interface {
+	Build(instances []*discover.ServiceInstance) Picker
+}
+
+//从实例列表中选出一个实例，实例列表为空时返回nil
+type Picker interface {
+	Pick() *discover.ServiceInstance
+}
+
+//可以原地更新实例列表的选择器，轮询位置、当前权重等状态在实例列表变化后得以保留，
+//否则每次变化后都从头开始，实例频繁变化时流量会集中到排在前面的实例
+type Updater interface {
+	Update(instances []*discover.ServiceInstance)
+}
+
+//使用函数实现Strategy
+type StrategyFunc func(instances []*discover.ServiceInstance) Picker
+
+func (f StrategyFunc) Build(instances []*discover.ServiceInstance) Picker {
+	return f(instances)
+}
+
+//轮询
+func RoundRobin() Strategy {
+	return StrategyFunc(func(instances []*discover.ServiceInstance) Picker {
+		return &roundRobinPicker{instances: instances}
+	})
+}
+
+type roundRobinPicker struct {
+	mutex     sync.RWMutex
+	instances []*discover.ServiceInstance
+	next      uint64
+}
+
+func (p *roundRobinPicker) Pick() *discover.ServiceInstance {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	if len(p.instances) == 0 {
+		return nil
+	}
+	n := atomic.AddUint64(&p.next, 1) - 1
+	return p.instances[n%uint64(len(p.instances))]
+}
+
+//保留轮询位置
+func (p *roundRobinPicker) Update(instances []*discover.ServiceInstance) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.instances = instances
+}
+
+//随机
+func Random() Strategy {
+	return StrategyFunc(func(instances []*discover.ServiceInstance) Picker {
+		return &randomPicker{
+			instances: instances,
+			rand:      rand.New(rand.NewSource(time.Now().UnixNano())),
+		}
+	})
+}
+
+type randomPicker struct {
+	instances []*discover.ServiceInstance
+	mutex     sync.Mutex
+	rand      *rand.Rand
+}
+
+func (p *randomPicker) Pick() *discover.ServiceInstance {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if len(p.instances) == 0 {
+		return nil
+	}
+	return p.instances[p.rand.Intn(len(p.instances))]
+}
+
+func (p *randomPicker) Update(instances []*discover.ServiceInstance) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.instances = instances
+}
+
+//平滑加权轮询（与nginx的算法一致），passing状态的实例使用Weights.Passing，
+//warning状态的实例使用Weights.Warning，权重未设置时按1处理
+func WeightedRoundRobin() Strategy {
+	return StrategyFunc(func(instances []*discover.ServiceInstance) Picker {
+		picker := &weightedPicker{}
+		picker.Update(instances)
+		return picker
+	})
+}
+
+type weightedPicker struct {
+	instances []*discover.ServiceInstance
+	weights   []int //实例的有效权重
+	current   []int //实例的当前权重
+	total     int
+	mutex     sync.Mutex
+}
+
+func (p *weightedPicker) Pick() *discover.ServiceInstance {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if len(p.instances) == 0 {
+		return nil
+	}
+	//每个实例的当前权重增加其有效权重，选出当前权重最大的实例，并将其当前权重减去总权重
+	best := 0
+	for i := range p.instances {
+		p.current[i] += p.weights[i]
+		if p.current[i] > p.current[best] {
+			best = i
+		}
+	}
+	p.current[best] -= p.total
+	return p.instances[best]
+}
+
+//按实例ID保留仍然存在的实例的当前权重，新增的实例从0开始，有效权重按新的健康状态重新计算
+func (p *weightedPicker) Update(instances []*discover.ServiceInstance) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	current := make(map[string]int, len(p.instances))
+	for i, instance := range p.instances {
+		current[instance.ID] = p.current[i]
+	}
+	p.instances = instances
+	p.weights = make([]int, len(instances))
+	p.current = make([]int, len(instances))
+	p.total = 0
+	for i, instance := range instances {
+		p.weights[i] = Weight(instance)
+		p.current[i] = current[instance.ID]
+		p.total += p.weights[i]
+	}
+}
+
+//根据实例的健康状态返回注册时写入consul的权重
+func Weight(instance *discover.ServiceInstance) int {
+	weight := instance.Weights.Passing
+	if instance.Status == discover.HealthWarning {
+		weight = instance.Weights.Warning
+	}
+	if weight <= 0 {
+		weight = 1
+	}
+	return weight
+}
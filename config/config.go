@@ -6,6 +6,12 @@ import (
 	"os"
 )
 
+//consul KV中的动态配置项，位于-config.prefix指定的目录下
+const (
+	//SayHello返回的问候语
+	KeyGreeting = "greeting"
+)
+
 var (
 	Logger    *log.Logger
 	KitLogger kitlog.Logger
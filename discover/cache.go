@@ -0,0 +1,249 @@
+package discover
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+)
+
+//单个服务的实例缓存，由后台的阻塞查询持续更新
+
+//consul查询响应的元信息
+type ResponseMeta struct {
+	Index       uint64        //X-Consul-Index，用于下一次阻塞查询
+	LastContact time.Duration //X-Consul-LastContact
+	KnownLeader bool          //X-Consul-KnownLeader
+}
+
+type serviceCache struct {
+	mutex     sync.RWMutex
+	instances []*ServiceInstance //可用的服务实例
+	meta      ResponseMeta       //最近一次成功查询的响应元信息
+	updated   time.Time          //最近一次成功更新的时间
+	synced    bool               //是否成功获取过数据
+	err       error              //最近一次查询的错误
+	failedAt  time.Time          //连续查询失败的开始时间，查询成功后清零
+	restored  bool               //实例来自本地快照，还没有从consul成功获取过数据
+	//每次从consul成功获取数据后调用，用于写入本地快照，为nil时不调用
+	persist   func(instances []*ServiceInstance, updatedAt time.Time)
+	readyOnce sync.Once
+	ready     chan struct{} //第一次查询完成（无论成功与否）后关闭
+	//订阅者的通知channel
+	subscribers map[chan struct{}]struct{}
+	closeOnce   sync.Once
+	closed      chan struct{} //监控停止后关闭
+}
+
+func newServiceCache() *serviceCache {
+	return &serviceCache{
+		ready:  make(chan struct{}),
+		closed: make(chan struct{}),
+	}
+}
+
+//监控停止后关闭缓存，所有订阅者的channel随之关闭
+func (c *serviceCache) close() {
+	c.closeOnce.Do(func() { close(c.closed) })
+}
+
+//使用最新的查询结果更新缓存
+func (c *serviceCache) update(instances []*ServiceInstance, meta ResponseMeta) {
+	now := time.Now()
+	c.mutex.Lock()
+	c.instances = instances
+	c.meta = meta
+	c.updated = now
+	c.synced = true
+	c.restored = false
+	c.err = nil
+	c.failedAt = time.Time{}
+	c.mutex.Unlock()
+	c.readyOnce.Do(func() { close(c.ready) })
+	c.notify()
+	if c.persist != nil {
+		c.persist(instances, now)
+	}
+}
+
+//使用本地快照中的实例作为初始数据，只在第一次查询失败时返回
+func (c *serviceCache) restore(instances []*ServiceInstance, updatedAt time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.synced {
+		return
+	}
+	c.instances = instances
+	c.updated = updatedAt
+	c.restored = true
+}
+
+//记录查询失败，已有的缓存数据继续保留
+func (c *serviceCache) fail(err error) {
+	c.mutex.Lock()
+	c.err = err
+	if c.failedAt.IsZero() {
+		c.failedAt = time.Now()
+	}
+	c.mutex.Unlock()
+	c.readyOnce.Do(func() { close(c.ready) })
+	c.notify()
+}
+
+//等待第一次查询完成后返回缓存的实例，不需要等待时为缓存命中。查询失败时返回之前获取的实例或本地快照，并标记为过期，
+//过期时间超过maxStale（大于0时）或没有任何数据时返回最近一次的错误
+func (c *serviceCache) get(ctx context.Context, maxStale time.Duration) ([]*ServiceInstance, QueryMeta, error) {
+	cached := true
+	select {
+	case <-c.ready:
+	default:
+		cached = false
+		select {
+		case <-c.ready:
+		case <-c.closed:
+			return nil, QueryMeta{}, ErrClientClosed
+		case <-ctx.Done():
+			return nil, QueryMeta{}, ctx.Err()
+		}
+	}
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	meta := QueryMeta{
+		Cached:      cached,
+		LastContact: c.meta.LastContact,
+		KnownLeader: c.meta.KnownLeader,
+	}
+	if c.err == nil && c.synced {
+		return c.instances, meta, nil
+	}
+	if !c.synced && !c.restored {
+		return nil, QueryMeta{Cached: cached}, c.err
+	}
+	meta.Stale = true
+	meta.Age = time.Since(c.updated)
+	meta.FromSnapshot = c.restored
+	if maxStale > 0 && meta.Age > maxStale {
+		return nil, QueryMeta{Cached: cached}, fmt.Errorf("%w (cached instances are %s old, exceeding the max staleness %s)", c.err, meta.Age.Round(time.Millisecond), maxStale)
+	}
+	return c.instances, meta, nil
+}
+
+//订阅服务实例的变化，ctx结束或监控停止后关闭返回的channel
+//每次推送都是订阅者上次收到之后的累计变化，消费较慢时中间的多次变化会被合并
+func (c *serviceCache) subscribe(ctx context.Context) <-chan Event {
+	out := make(chan Event, 1)
+	notify := make(chan struct{}, 1)
+	c.mutex.Lock()
+	if c.subscribers == nil {
+		c.subscribers = make(map[chan struct{}]struct{})
+	}
+	c.subscribers[notify] = struct{}{}
+	c.mutex.Unlock()
+
+	go func() {
+		defer close(out)
+		defer func() {
+			c.mutex.Lock()
+			delete(c.subscribers, notify)
+			c.mutex.Unlock()
+		}()
+		//已经有数据时立即推送一次当前的实例列表
+		select {
+		case <-c.ready:
+			signal(notify)
+		default:
+		}
+		var (
+			last    []*ServiceInstance
+			lastErr error
+			sent    bool
+		)
+		for {
+			select {
+			case <-notify:
+			case <-c.closed:
+				return
+			case <-ctx.Done():
+				return
+			}
+			c.mutex.RLock()
+			instances, synced, err := c.instances, c.synced, c.err
+			c.mutex.RUnlock()
+			added, removed, changed := DiffInstances(last, instances)
+			//数据和错误都没有变化时不推送
+			if sent && !changed && errorString(err) == errorString(lastErr) {
+				continue
+			}
+			if !synced && err == nil {
+				continue
+			}
+			event := Event{
+				Instances: instances,
+				Added:     added,
+				Removed:   removed,
+				Err:       err,
+			}
+			select {
+			case out <- event:
+				last, lastErr, sent = instances, err, true
+			case <-c.closed:
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
+
+//通知所有订阅者缓存发生了变化
+func (c *serviceCache) notify() {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	for subscriber := range c.subscribers {
+		signal(subscriber)
+	}
+}
+
+//非阻塞地发送通知，已有未处理的通知时直接丢弃
+func signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+//比较两次的实例列表，返回新增和移除的实例，以及实例列表是否发生了变化
+func DiffInstances(old, new []*ServiceInstance) (added, removed []*ServiceInstance, changed bool) {
+	oldMap := make(map[string]*ServiceInstance, len(old))
+	for _, instance := range old {
+		oldMap[instance.ID] = instance
+	}
+	newMap := make(map[string]*ServiceInstance, len(new))
+	for _, instance := range new {
+		newMap[instance.ID] = instance
+		prev, ok := oldMap[instance.ID]
+		if !ok {
+			added = append(added, instance)
+			changed = true
+		} else if !reflect.DeepEqual(prev, instance) {
+			//实例的地址、权重、健康状态等发生变化
+			changed = true
+		}
+	}
+	for _, instance := range old {
+		if _, ok := newMap[instance.ID]; !ok {
+			removed = append(removed, instance)
+			changed = true
+		}
+	}
+	return added, removed, changed
+}
+
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
@@ -0,0 +1,296 @@
+package discover
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//服务实例的健康检查定义，一个服务实例可以注册多个检查，任意检查为critical时实例不可用。
+//HTTP、TCP、GRPC、TTL必须且只能设置一个
+
+//没有设置Checks时，按HealthCheckUrl和TTL生成的默认检查使用的配置
+const (
+	defaultCheckInterval        = 15 * time.Second
+	defaultCheckDeregisterAfter = 30 * time.Second
+)
+
+type CheckDefinition struct {
+	ID   string //检查ID，为空时与consul一致：单个检查为service:<instanceId>，多个检查时为service:<instanceId>:<序号>
+	Name string //检查名
+
+	//HTTP(S)检查的url，以/开头时视为服务实例上的路径
+	HTTP          string
+	Method        string              //请求方法，为空时使用GET
+	Header        map[string][]string //请求头
+	TLSSkipVerify bool                //https检查时不校验证书
+
+	//TCP检查的地址host:port，为self时使用服务实例的地址
+	TCP string
+
+	//gRPC健康检查的地址host:port[/service]，以/开头时视为服务实例上的service
+	GRPC       string
+	GRPCUseTLS bool
+
+	//TTL检查，由服务实例主动上报心跳
+	TTL time.Duration
+
+	Interval                       time.Duration //consul主动检查的间隔，HTTP、TCP、gRPC检查必须设置
+	Timeout                        time.Duration //单次检查的超时时间，为0时使用consul的默认值
+	DeregisterCriticalServiceAfter time.Duration //检查持续critical多久之后注销实例，为0时不自动注销
+}
+
+//检查的类型，http、tcp、grpc或ttl，没有设置时返回空字符串
+func (c *CheckDefinition) Type() string {
+	switch {
+	case c.HTTP != "":
+		return "http"
+	case c.TCP != "":
+		return "tcp"
+	case c.GRPC != "":
+		return "grpc"
+	case c.TTL > 0:
+		return "ttl"
+	}
+	return ""
+}
+
+func (c *CheckDefinition) validate() error {
+	types := 0
+	for _, set := range []bool{c.HTTP != "", c.TCP != "", c.GRPC != "", c.TTL > 0} {
+		if set {
+			types++
+		}
+	}
+	if types != 1 {
+		return fmt.Errorf("%w: check %q must set exactly one of http, tcp, grpc and ttl", ErrInvalidRegistration, c.Name)
+	}
+	if c.TTL <= 0 && c.Interval <= 0 {
+		return fmt.Errorf("%w: %s check %q requires an interval", ErrInvalidRegistration, c.Type(), c.Name)
+	}
+	if c.Interval < 0 || c.Timeout < 0 || c.DeregisterCriticalServiceAfter < 0 {
+		return fmt.Errorf("%w: check %q has a negative duration", ErrInvalidRegistration, c.Name)
+	}
+	return nil
+}
+
+//注册时实际使用的检查：补全检查ID，并将相对于服务实例的地址转换为完整地址
+func (r *Registration) EffectiveChecks() []*CheckDefinition {
+	if len(r.Checks) == 0 {
+		check := &CheckDefinition{DeregisterCriticalServiceAfter: defaultCheckDeregisterAfter}
+		if r.TTL > 0 {
+			check.TTL = r.TTL
+		} else {
+			check.HTTP = "http://" + r.address() + r.HealthCheckUrl
+			check.Interval = defaultCheckInterval
+		}
+		check.ID = defaultCheckId(r.InstanceId)
+		return []*CheckDefinition{check}
+	}
+	checks := make([]*CheckDefinition, 0, len(r.Checks))
+	for i, check := range r.Checks {
+		copied := *check
+		if copied.ID == "" {
+			copied.ID = defaultCheckId(r.InstanceId)
+			if len(r.Checks) > 1 {
+				copied.ID += ":" + strconv.Itoa(i+1)
+			}
+		}
+		if strings.HasPrefix(copied.HTTP, "/") {
+			copied.HTTP = "http://" + r.address() + copied.HTTP
+		}
+		if strings.HasPrefix(copied.GRPC, "/") {
+			copied.GRPC = r.address() + copied.GRPC
+		}
+		if copied.TCP == instanceAddress {
+			copied.TCP = r.address()
+		}
+		checks = append(checks, &copied)
+	}
+	return checks
+}
+
+//服务实例的host:port
+func (r *Registration) address() string {
+	return net.JoinHostPort(r.InstanceHost, strconv.Itoa(r.InstancePort))
+}
+
+//TCP检查的地址为该值时使用服务实例的地址
+const instanceAddress = "self"
+
+//consul要求的时间格式，为0时返回空字符串
+func durationString(d time.Duration) string {
+	if d <= 0 {
+		return ""
+	}
+	return d.String()
+}
+
+//解析命令行中的检查定义，格式为 类型=目标[,选项...]，例如：
+//	http=/health,interval=10s,timeout=2s,deregister=1m
+//	http=https://127.0.0.1:8443/health,method=HEAD,header=Authorization:Bearer x,skip-verify,interval=10s
+//	tcp=self,interval=10s
+//	grpc=/grpc.health.v1.Health,tls,interval=10s
+//	ttl=15s
+//http和grpc的目标以/开头时视为服务实例上的路径，tcp的目标为self时使用服务实例的地址
+func ParseCheckDefinition(spec string) (*CheckDefinition, error) {
+	check := &CheckDefinition{}
+	for i, field := range strings.Split(spec, ",") {
+		field = strings.TrimSpace(field)
+		key, value := field, ""
+		if index := strings.Index(field, "="); index >= 0 {
+			key, value = field[:index], field[index+1:]
+		}
+		if i == 0 {
+			switch key {
+			case "http":
+				check.HTTP = value
+			case "tcp":
+				check.TCP = value
+			case "grpc":
+				check.GRPC = value
+			case "ttl":
+				ttl, err := time.ParseDuration(value)
+				if err != nil {
+					return nil, fmt.Errorf("invalid check %q: ttl: %v", spec, err)
+				}
+				check.TTL = ttl
+			default:
+				return nil, fmt.Errorf("invalid check %q: unknown type %q", spec, key)
+			}
+			continue
+		}
+		var err error
+		switch key {
+		case "id":
+			check.ID = value
+		case "name":
+			check.Name = value
+		case "method":
+			check.Method = strings.ToUpper(value)
+		case "header":
+			index := strings.Index(value, ":")
+			if index <= 0 {
+				return nil, fmt.Errorf("invalid check %q: header must be name:value", spec)
+			}
+			if check.Header == nil {
+				check.Header = make(map[string][]string)
+			}
+			name := strings.TrimSpace(value[:index])
+			check.Header[name] = append(check.Header[name], strings.TrimSpace(value[index+1:]))
+		case "skip-verify":
+			check.TLSSkipVerify = true
+		case "tls":
+			check.GRPCUseTLS = true
+		case "interval":
+			check.Interval, err = time.ParseDuration(value)
+		case "timeout":
+			check.Timeout, err = time.ParseDuration(value)
+		case "deregister":
+			check.DeregisterCriticalServiceAfter, err = time.ParseDuration(value)
+		default:
+			return nil, fmt.Errorf("invalid check %q: unknown option %q", spec, key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid check %q: %s: %v", spec, key, err)
+		}
+	}
+	if err := check.validate(); err != nil {
+		return nil, err
+	}
+	return check, nil
+}
+
+//可以重复指定的命令行参数，每次指定解析一个检查定义
+type CheckDefinitions []*CheckDefinition
+
+func (c *CheckDefinitions) String() string {
+	if c == nil {
+		return ""
+	}
+	types := make([]string, 0, len(*c))
+	for _, check := range *c {
+		types = append(types, check.Type())
+	}
+	return strings.Join(types, ",")
+}
+
+func (c *CheckDefinitions) Set(spec string) error {
+	check, err := ParseCheckDefinition(spec)
+	if err != nil {
+		return err
+	}
+	*c = append(*c, check)
+	return nil
+}
+
+//配置文件中的检查定义，时间使用字符串格式，如10s
+type checkFile struct {
+	ID                             string              `json:"id"`
+	Name                           string              `json:"name"`
+	HTTP                           string              `json:"http"`
+	Method                         string              `json:"method"`
+	Header                         map[string][]string `json:"header"`
+	TLSSkipVerify                  bool                `json:"tls_skip_verify"`
+	TCP                            string              `json:"tcp"`
+	GRPC                           string              `json:"grpc"`
+	GRPCUseTLS                     bool                `json:"grpc_use_tls"`
+	TTL                            string              `json:"ttl"`
+	Interval                       string              `json:"interval"`
+	Timeout                        string              `json:"timeout"`
+	DeregisterCriticalServiceAfter string              `json:"deregister_critical_service_after"`
+}
+
+//从json配置文件中读取检查定义，文件内容为检查的数组，例如：
+//	[{"name":"http","http":"/health","interval":"10s","timeout":"2s","deregister_critical_service_after":"1m"},
+//	 {"name":"tcp","tcp":"self","interval":"10s"}]
+func LoadCheckDefinitions(path string) ([]*CheckDefinition, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read check config: %w", err)
+	}
+	var files []checkFile
+	if err := json.Unmarshal(data, &files); err != nil {
+		return nil, fmt.Errorf("parse check config %s: %w", path, err)
+	}
+	checks := make([]*CheckDefinition, 0, len(files))
+	for _, f := range files {
+		check := &CheckDefinition{
+			ID:            f.ID,
+			Name:          f.Name,
+			HTTP:          f.HTTP,
+			Method:        f.Method,
+			Header:        f.Header,
+			TLSSkipVerify: f.TLSSkipVerify,
+			TCP:           f.TCP,
+			GRPC:          f.GRPC,
+			GRPCUseTLS:    f.GRPCUseTLS,
+		}
+		for _, d := range []struct {
+			name  string
+			value string
+			to    *time.Duration
+		}{
+			{"ttl", f.TTL, &check.TTL},
+			{"interval", f.Interval, &check.Interval},
+			{"timeout", f.Timeout, &check.Timeout},
+			{"deregister_critical_service_after", f.DeregisterCriticalServiceAfter, &check.DeregisterCriticalServiceAfter},
+		} {
+			if d.value == "" {
+				continue
+			}
+			if *d.to, err = time.ParseDuration(d.value); err != nil {
+				return nil, fmt.Errorf("parse check config %s: check %q: %s: %v", path, f.Name, d.name, err)
+			}
+		}
+		if err := check.validate(); err != nil {
+			return nil, err
+		}
+		checks = append(checks, check)
+	}
+	return checks, nil
+}
@@ -0,0 +1,553 @@
+package discover_test
+
+import (
+	"context"
+	"errors"
+	"gomicro-discover/discover"
+	"gomicro-discover/discover/consulapi"
+	"gomicro-discover/discover/discovertest"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+//HTTPDiscoverClient和consulapi包的kitDiscoverClient连接discovertest.ConsulServer的端到端测试，
+//两个客户端运行相同的用例
+
+type clientFactory func(server *discovertest.ConsulServer, opts ...discover.ClientOption) (discover.Client, error)
+
+var clientFactories = map[string]clientFactory{
+	"http": func(server *discovertest.ConsulServer, opts ...discover.ClientOption) (discover.Client, error) {
+		return discover.NewHTTPDiscoverClient(server.Host(), server.Port(), opts...)
+	},
+	"kit": func(server *discovertest.ConsulServer, opts ...discover.ClientOption) (discover.Client, error) {
+		return consulapi.NewKitDiscoverClient(server.Host(), server.Port(), opts...)
+	},
+}
+
+//单个用例的运行环境
+type clientEnv struct {
+	t       *testing.T
+	server  *discovertest.ConsulServer
+	factory clientFactory
+	ctx     context.Context
+	clients []discover.Client
+}
+
+//连接fake consul创建客户端，用例结束时关闭
+func (e *clientEnv) newClient(opts ...discover.ClientOption) discover.Client {
+	client, err := e.factory(e.server, opts...)
+	if err != nil {
+		e.t.Fatalf("create client: %v", err)
+	}
+	e.clients = append(e.clients, client)
+	return client
+}
+
+//对每个客户端分别启动fake consul并运行用例
+func forEachClient(t *testing.T, test func(t *testing.T, env *clientEnv)) {
+	for name, factory := range clientFactories {
+		factory := factory
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			env := &clientEnv{t: t, server: discovertest.NewConsulServer(), factory: factory, ctx: ctx}
+			defer env.server.Close()
+			defer func() {
+				for _, client := range env.clients {
+					client.Close()
+				}
+			}()
+			test(t, env)
+		})
+	}
+}
+
+func testRegistration(instanceId string) *discover.Registration {
+	return &discover.Registration{
+		ServiceName:    "string-service",
+		InstanceId:     instanceId,
+		InstanceHost:   "127.0.0.1",
+		InstancePort:   10085,
+		HealthCheckUrl: "/health",
+		Meta:           map[string]string{"version": "2"},
+		Tags:           []string{"primary"},
+		Weights:        discover.Weights{Passing: 5},
+	}
+}
+
+//等待cond成立，超时后测试失败
+func eventually(t *testing.T, message string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", message)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+//等待订阅推送满足cond的事件
+func waitEvent(t *testing.T, events <-chan discover.Event, cond func(discover.Event) bool) discover.Event {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				t.Fatal("subscription closed")
+			}
+			if cond(event) {
+				return event
+			}
+		case <-timeout:
+			t.Fatal("timed out waiting for event")
+		}
+	}
+}
+
+func TestRegisterDiscoverDeregister(t *testing.T) {
+	forEachClient(t, func(t *testing.T, env *clientEnv) {
+		server := env.server
+		client := env.newClient()
+		ctx := env.ctx
+		if err := client.Register(ctx, testRegistration("string-service-1")); err != nil {
+			t.Fatalf("register: %v", err)
+		}
+		if !server.Registered("string-service-1") {
+			t.Fatal("instance is not registered on the agent")
+		}
+		if status := server.CheckStatus("service:string-service-1"); status != "passing" {
+			t.Fatalf("check status = %q, want passing", status)
+		}
+
+		instances, err := client.DiscoverService(ctx, "string-service", discover.WithTags("primary"), discover.WithMeta("version", "2"))
+		if err != nil {
+			t.Fatalf("discover: %v", err)
+		}
+		if len(instances) != 1 {
+			t.Fatalf("got %d instances, want 1", len(instances))
+		}
+		instance := instances[0]
+		if instance.ID != "string-service-1" || instance.Address != "127.0.0.1" || instance.Port != 10085 {
+			t.Fatalf("unexpected instance %+v", instance)
+		}
+		if instance.Datacenter != server.Datacenter || instance.Node != server.Node {
+			t.Fatalf("instance datacenter/node = %s/%s, want %s/%s", instance.Datacenter, instance.Node, server.Datacenter, server.Node)
+		}
+		//未设置的warning权重使用默认值
+		if want := (discover.Weights{Passing: 5, Warning: 1}); instance.Weights != want {
+			t.Fatalf("instance weights = %+v, want %+v", instance.Weights, want)
+		}
+		if _, err := client.DiscoverService(ctx, "string-service", discover.WithTags("canary")); !errors.Is(err, discover.ErrServiceNotFound) {
+			t.Fatalf("discover with unmatched tag: err = %v, want ErrServiceNotFound", err)
+		}
+
+		if err := client.Deregister(ctx, "string-service-1"); err != nil {
+			t.Fatalf("deregister: %v", err)
+		}
+		if server.Registered("string-service-1") {
+			t.Fatal("instance is still registered on the agent")
+		}
+		eventually(t, "instance to disappear", func() bool {
+			_, err := client.DiscoverService(ctx, "string-service")
+			return errors.Is(err, discover.ErrServiceNotFound)
+		})
+		if err := client.Deregister(ctx, "string-service-1"); !errors.Is(err, discover.ErrServiceNotFound) {
+			t.Fatalf("deregister unknown instance: err = %v, want ErrServiceNotFound", err)
+		}
+	})
+}
+
+func TestRegisterInvalid(t *testing.T) {
+	forEachClient(t, func(t *testing.T, env *clientEnv) {
+		server := env.server
+		registration := testRegistration("string-service-1")
+		registration.InstancePort = 0
+		if err := env.newClient().Register(env.ctx, registration); !errors.Is(err, discover.ErrInvalidRegistration) {
+			t.Fatalf("err = %v, want ErrInvalidRegistration", err)
+		}
+		if server.Requests("/v1/agent/service/register") != 0 {
+			t.Fatal("invalid registration was sent to the agent")
+		}
+	})
+}
+
+//注册超时返回失败后，迟到的注册不能留在agent上，但不能注销之后重试成功的注册
+func TestRegisterCanceled(t *testing.T) {
+	forEachClient(t, func(t *testing.T, env *clientEnv) {
+		server := env.server
+		client := env.newClient()
+		register := func(timeout time.Duration) error {
+			ctx, cancel := context.WithTimeout(env.ctx, timeout)
+			defer cancel()
+			return client.Register(ctx, testRegistration("string-service-1"))
+		}
+		server.DelayRequests(200 * time.Millisecond)
+		if err := register(20 * time.Millisecond); err == nil {
+			t.Fatal("register succeeded after the context expired")
+		}
+		server.DelayRequests(0)
+		time.Sleep(400 * time.Millisecond)
+		if server.Registered("string-service-1") {
+			t.Fatal("canceled registration is left on the agent")
+		}
+
+		server.DelayRequests(200 * time.Millisecond)
+		if err := register(20 * time.Millisecond); err == nil {
+			t.Fatal("register succeeded after the context expired")
+		}
+		if err := register(5 * time.Second); err != nil {
+			t.Fatalf("retry register: %v", err)
+		}
+		time.Sleep(400 * time.Millisecond)
+		if !server.Registered("string-service-1") {
+			t.Fatal("retried registration was deregistered")
+		}
+	})
+}
+
+//后续的查询由第一次查询启动的阻塞查询监控的缓存处理，不会再请求consul
+func TestDiscoverUsesWatchCache(t *testing.T) {
+	forEachClient(t, func(t *testing.T, env *clientEnv) {
+		server := env.server
+		client := env.newClient()
+		ctx := env.ctx
+		if err := client.Register(ctx, testRegistration("string-service-1")); err != nil {
+			t.Fatalf("register: %v", err)
+		}
+		var meta discover.QueryMeta
+		if _, err := client.DiscoverService(ctx, "string-service", discover.WithQueryMeta(&meta)); err != nil {
+			t.Fatalf("discover: %v", err)
+		}
+		if meta.Cached {
+			t.Fatal("first discovery should wait for the watch")
+		}
+		for i := 0; i < 10; i++ {
+			if _, err := client.DiscoverService(ctx, "string-service", discover.WithQueryMeta(&meta)); err != nil {
+				t.Fatalf("discover: %v", err)
+			}
+			if !meta.Cached {
+				t.Fatal("discovery should be answered by the watch cache")
+			}
+		}
+		//第一次查询和等待中的阻塞查询
+		if n := server.Requests("/v1/health/service/string-service"); n > 2 {
+			t.Fatalf("got %d health queries, want at most 2", n)
+		}
+
+		watches := client.(discover.WatchLister).Watches()
+		if len(watches) != 1 || watches[0].ServiceName != "string-service" || watches[0].Instances != 1 {
+			t.Fatalf("unexpected watches %+v", watches)
+		}
+	})
+}
+
+func TestSubscribe(t *testing.T) {
+	forEachClient(t, func(t *testing.T, env *clientEnv) {
+		server := env.server
+		client := env.newClient()
+		ctx := env.ctx
+		events, err := client.Subscribe(ctx, "string-service")
+		if err != nil {
+			t.Fatalf("subscribe: %v", err)
+		}
+
+		if err := client.Register(ctx, testRegistration("string-service-1")); err != nil {
+			t.Fatalf("register: %v", err)
+		}
+		event := waitEvent(t, events, func(event discover.Event) bool { return len(event.Added) > 0 })
+		if len(event.Instances) != 1 || event.Added[0].ID != "string-service-1" {
+			t.Fatalf("unexpected event %+v", event)
+		}
+
+		//检查失败的实例被移除
+		server.SetCheckStatus("string-service-1", "critical")
+		event = waitEvent(t, events, func(event discover.Event) bool { return len(event.Removed) > 0 })
+		if len(event.Instances) != 0 || event.Removed[0].ID != "string-service-1" {
+			t.Fatalf("unexpected event %+v", event)
+		}
+		server.SetCheckStatus("string-service-1", "passing")
+		waitEvent(t, events, func(event discover.Event) bool { return len(event.Added) > 0 })
+
+		if err := client.Deregister(ctx, "string-service-1"); err != nil {
+			t.Fatalf("deregister: %v", err)
+		}
+		event = waitEvent(t, events, func(event discover.Event) bool { return len(event.Removed) > 0 })
+		if len(event.Instances) != 0 {
+			t.Fatalf("unexpected event %+v", event)
+		}
+
+		//客户端关闭后订阅随之关闭
+		client.Close()
+		eventually(t, "subscription to close", func() bool {
+			select {
+			case _, ok := <-events:
+				return !ok
+			default:
+				return false
+			}
+		})
+	})
+}
+
+//订阅使用指定的数据中心和一致性模式，与相同条件的查询共用同一个监控
+func TestSubscribeQueryOptions(t *testing.T) {
+	forEachClient(t, func(t *testing.T, env *clientEnv) {
+		server := env.server
+		client := env.newClient()
+		ctx := env.ctx
+		if err := client.Register(ctx, testRegistration("string-service-1")); err != nil {
+			t.Fatalf("register: %v", err)
+		}
+		if _, err := client.DiscoverService(ctx, "string-service"); err != nil {
+			t.Fatalf("discover: %v", err)
+		}
+		events, err := client.Subscribe(ctx, "string-service")
+		if err != nil {
+			t.Fatalf("subscribe: %v", err)
+		}
+		waitEvent(t, events, func(event discover.Event) bool { return len(event.Instances) == 1 })
+		if watches := client.(discover.WatchLister).Watches(); len(watches) != 1 || watches[0].Subscribers != 1 {
+			t.Fatalf("unexpected watches %+v", watches)
+		}
+
+		//不存在的数据中心推送错误，而不是本地数据中心的实例
+		events, err = client.Subscribe(ctx, "string-service", discover.WithDatacenter("dc2"))
+		if err != nil {
+			t.Fatalf("subscribe dc2: %v", err)
+		}
+		event := waitEvent(t, events, func(event discover.Event) bool { return event.Err != nil })
+		if !errors.Is(event.Err, discover.ErrRegistryUnavailable) || len(event.Instances) != 0 {
+			t.Fatalf("unexpected event %+v", event)
+		}
+
+		events, err = client.Subscribe(ctx, "string-service", discover.WithConsistency(discover.ConsistencyConsistent, 0))
+		if err != nil {
+			t.Fatalf("subscribe consistent: %v", err)
+		}
+		waitEvent(t, events, func(event discover.Event) bool { return len(event.Instances) == 1 })
+		if mode := server.LastConsistency(); mode != "consistent" {
+			t.Fatalf("consistency = %q, want consistent", mode)
+		}
+		watches := client.(discover.WatchLister).Watches()
+		if len(watches) != 3 {
+			t.Fatalf("unexpected watches %+v", watches)
+		}
+	})
+}
+
+func TestMaintenanceAndPing(t *testing.T) {
+	forEachClient(t, func(t *testing.T, env *clientEnv) {
+		server := env.server
+		client := env.newClient()
+		ctx := env.ctx
+		if err := client.(discover.Pinger).Ping(ctx); err != nil {
+			t.Fatalf("ping: %v", err)
+		}
+		if err := client.Register(ctx, testRegistration("string-service-1")); err != nil {
+			t.Fatalf("register: %v", err)
+		}
+		setter := client.(discover.MaintenanceSetter)
+		if err := setter.SetMaintenance(ctx, "string-service-1", true, "draining"); err != nil {
+			t.Fatalf("enable maintenance: %v", err)
+		}
+		if status := server.CheckStatus("_service_maintenance:string-service-1"); status != "critical" {
+			t.Fatalf("maintenance check status = %q, want critical", status)
+		}
+		if _, err := client.DiscoverService(ctx, "string-service"); !errors.Is(err, discover.ErrServiceNotFound) {
+			t.Fatalf("discover instance in maintenance: err = %v, want ErrServiceNotFound", err)
+		}
+		if err := setter.SetMaintenance(ctx, "string-service-1", false, ""); err != nil {
+			t.Fatalf("disable maintenance: %v", err)
+		}
+		eventually(t, "instance to leave maintenance", func() bool {
+			_, err := client.DiscoverService(ctx, "string-service")
+			return err == nil
+		})
+		if err := setter.SetMaintenance(ctx, "unknown", true, ""); !errors.Is(err, discover.ErrServiceNotFound) {
+			t.Fatalf("maintenance of unknown instance: err = %v, want ErrServiceNotFound", err)
+		}
+
+		server.FailRequests(503)
+		if err := client.(discover.Pinger).Ping(ctx); !errors.Is(err, discover.ErrRegistryUnavailable) {
+			t.Fatalf("ping unavailable consul: err = %v, want ErrRegistryUnavailable", err)
+		}
+	})
+}
+
+//agent丢失注册后Registrar通过Registered发现并重新注册
+func TestRegistrarReregistersDroppedService(t *testing.T) {
+	forEachClient(t, func(t *testing.T, env *clientEnv) {
+		server := env.server
+		client := env.newClient()
+		ctx := env.ctx
+		registered, err := client.(discover.RegistrationChecker).Registered(ctx, "string-service-1")
+		if err != nil || registered {
+			t.Fatalf("Registered before register = %v, %v, want false, nil", registered, err)
+		}
+
+		registrar := discover.NewRegistrar(client, testRegistration("string-service-1"), discover.WithReconcileInterval(20*time.Millisecond))
+		registrar.Start()
+		defer registrar.Deregister(ctx)
+		eventually(t, "registration", registrar.Registered)
+
+		server.DropService("string-service-1")
+		eventually(t, "re-registration", func() bool {
+			return server.Registered("string-service-1") && registrar.Status().Reregistrations == 1
+		})
+	})
+}
+
+//指定的数据中心不可达时按顺序查询故障转移的数据中心
+func TestDatacenterFailover(t *testing.T) {
+	forEachClient(t, func(t *testing.T, env *clientEnv) {
+		server := env.server
+		client := env.newClient()
+		ctx := env.ctx
+		if err := client.Register(ctx, testRegistration("string-service-1")); err != nil {
+			t.Fatalf("register: %v", err)
+		}
+		if _, err := client.DiscoverService(ctx, "string-service", discover.WithDatacenter("dc2")); !errors.Is(err, discover.ErrRegistryUnavailable) {
+			t.Fatalf("discover in unknown datacenter: err = %v, want ErrRegistryUnavailable", err)
+		}
+		instances, err := client.DiscoverService(ctx, "string-service", discover.WithDatacenter("dc2"), discover.WithFailover(server.Datacenter))
+		if err != nil {
+			t.Fatalf("discover with failover: %v", err)
+		}
+		if len(instances) != 1 || instances[0].Datacenter != server.Datacenter {
+			t.Fatalf("unexpected instances %+v", instances)
+		}
+
+		watches := client.(discover.WatchLister).Watches()
+		if len(watches) != 2 || watches[0].Datacenter != server.Datacenter || watches[1].Datacenter != "dc2" || watches[1].Error == "" {
+			t.Fatalf("unexpected watches %+v", watches)
+		}
+	})
+}
+
+//consul不可达时返回之前获取的实例，新的客户端从本地快照中恢复
+func TestSnapshot(t *testing.T) {
+	forEachClient(t, func(t *testing.T, env *clientEnv) {
+		server := env.server
+		dir, err := ioutil.TempDir("", "discover")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "snapshot.json")
+		ctx := env.ctx
+
+		client := env.newClient(discover.WithSnapshot(path, 0))
+		if err := client.Register(ctx, testRegistration("string-service-1")); err != nil {
+			t.Fatalf("register: %v", err)
+		}
+		if _, err := client.DiscoverService(ctx, "string-service"); err != nil {
+			t.Fatalf("discover: %v", err)
+		}
+
+		server.FailRequests(500)
+		var meta discover.QueryMeta
+		eventually(t, "stale result", func() bool {
+			instances, err := client.DiscoverService(ctx, "string-service", discover.WithQueryMeta(&meta))
+			return err == nil && len(instances) == 1 && meta.Stale
+		})
+		if meta.FromSnapshot {
+			t.Fatal("stale result of a synced watch should not come from the snapshot")
+		}
+
+		restored := env.newClient(discover.WithSnapshot(path, 0))
+		instances, err := restored.DiscoverService(ctx, "string-service", discover.WithQueryMeta(&meta))
+		if err != nil {
+			t.Fatalf("discover from snapshot: %v", err)
+		}
+		if len(instances) != 1 || instances[0].ID != "string-service-1" || !meta.Stale || !meta.FromSnapshot {
+			t.Fatalf("unexpected result %+v, meta %+v", instances, meta)
+		}
+
+		//过期时间超过maxStale时返回错误
+		expired := env.newClient(discover.WithSnapshot(path, time.Nanosecond))
+		if _, err := expired.DiscoverService(ctx, "string-service"); !errors.Is(err, discover.ErrRegistryUnavailable) {
+			t.Fatalf("discover expired snapshot: err = %v, want ErrRegistryUnavailable", err)
+		}
+	})
+}
+
+//全部实例都不可用时不覆盖快照中最近一次可用的实例
+func TestSnapshotKeepsLastHealthyInstances(t *testing.T) {
+	forEachClient(t, func(t *testing.T, env *clientEnv) {
+		server := env.server
+		dir, err := ioutil.TempDir("", "discover")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "snapshot.json")
+		ctx := env.ctx
+
+		client := env.newClient(discover.WithSnapshot(path, 0))
+		if err := client.Register(ctx, testRegistration("string-service-1")); err != nil {
+			t.Fatalf("register: %v", err)
+		}
+		if _, err := client.DiscoverService(ctx, "string-service"); err != nil {
+			t.Fatalf("discover: %v", err)
+		}
+		server.SetCheckStatus("string-service-1", "critical")
+		eventually(t, "instance to become unavailable", func() bool {
+			_, err := client.DiscoverService(ctx, "string-service")
+			return errors.Is(err, discover.ErrServiceNotFound)
+		})
+
+		server.FailRequests(500)
+		restored := env.newClient(discover.WithSnapshot(path, 0))
+		instances, err := restored.DiscoverService(ctx, "string-service")
+		if err != nil {
+			t.Fatalf("discover from snapshot: %v", err)
+		}
+		if len(instances) != 1 || instances[0].ID != "string-service-1" {
+			t.Fatalf("unexpected instances %+v", instances)
+		}
+	})
+}
+
+func TestConsistency(t *testing.T) {
+	forEachClient(t, func(t *testing.T, env *clientEnv) {
+		server := env.server
+		ctx := env.ctx
+		client := env.newClient(discover.WithDefaultConsistency(discover.ConsistencyStale, 0))
+		if err := client.Register(ctx, testRegistration("string-service-1")); err != nil {
+			t.Fatalf("register: %v", err)
+		}
+		if _, err := client.DiscoverService(ctx, "string-service"); err != nil {
+			t.Fatalf("discover: %v", err)
+		}
+		if mode := server.LastConsistency(); mode != "stale" {
+			t.Fatalf("consistency = %q, want stale", mode)
+		}
+		if _, err := client.DiscoverService(ctx, "string-service", discover.WithConsistency(discover.ConsistencyConsistent, 0)); err != nil {
+			t.Fatalf("discover: %v", err)
+		}
+		if mode := server.LastConsistency(); mode != "consistent" {
+			t.Fatalf("consistency = %q, want consistent", mode)
+		}
+
+		//与leader失联超过MaxStale的结果不被使用
+		server.SetLastContact(time.Minute)
+		var meta discover.QueryMeta
+		if _, err := client.DiscoverService(ctx, "string-service", discover.WithConsistency(discover.ConsistencyStale, time.Second), discover.WithQueryMeta(&meta)); err != nil {
+			t.Fatalf("discover: %v", err)
+		}
+		if meta.LastContact != 0 || !meta.KnownLeader {
+			t.Fatalf("meta = %+v, want LastContact 0 from the leader", meta)
+		}
+		//没有限制MaxStale时使用follower的结果，SetCheckStatus唤醒已有监控的阻塞查询
+		server.SetCheckStatus("string-service-1", "passing")
+		eventually(t, "LastContact of the follower", func() bool {
+			_, err := client.DiscoverService(ctx, "string-service", discover.WithQueryMeta(&meta))
+			return err == nil && meta.LastContact == time.Minute
+		})
+	})
+}
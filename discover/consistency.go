@@ -0,0 +1,86 @@
+package discover
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+)
+
+//服务发现读取的一致性模式，可以为客户端设置默认值，也可以在每次查询时指定。
+//不同模式的查询使用各自的监控和缓存
+
+type ConsistencyMode string
+
+const (
+	//由leader处理，leader切换期间可能读到短暂过期的数据，consul的默认模式
+	ConsistencyDefault ConsistencyMode = "default"
+	//任意server都可以处理，减轻leader的压力，适合读多的网关，可以通过MaxStale限制过期时间
+	ConsistencyStale ConsistencyMode = "stale"
+	//leader与多数server确认自己仍是leader后处理，保证读到最新的数据，开销最大
+	ConsistencyConsistent ConsistencyMode = "consistent"
+	//由本地agent的缓存处理，agent在后台刷新缓存
+	ConsistencyCached ConsistencyMode = "cached"
+)
+
+type Consistency struct {
+	Mode ConsistencyMode //为空时使用客户端的默认模式
+	//stale模式下允许的最长过期时间，处理请求的server与leader失联超过该时间时改由leader处理，为0时不限制
+	MaxStale time.Duration
+}
+
+//解析一致性模式，为空时返回空字符串表示使用默认模式
+func ParseConsistencyMode(mode string) (ConsistencyMode, error) {
+	switch m := ConsistencyMode(mode); m {
+	case "", ConsistencyDefault, ConsistencyStale, ConsistencyConsistent, ConsistencyCached:
+		return m, nil
+	}
+	return "", fmt.Errorf("invalid consistency mode %q, expected default, stale, consistent or cached", mode)
+}
+
+//客户端默认的一致性模式，maxStale只在stale模式下有效
+func WithDefaultConsistency(mode ConsistencyMode, maxStale time.Duration) ClientOption {
+	return func(o *clientOptions) {
+		o.consistency = Consistency{Mode: mode, MaxStale: maxStale}
+	}
+}
+
+//本次查询使用的一致性模式，maxStale只在stale模式下有效
+func WithConsistency(mode ConsistencyMode, maxStale time.Duration) QueryOption {
+	return func(o *QueryOptions) {
+		o.Consistency = Consistency{Mode: mode, MaxStale: maxStale}
+	}
+}
+
+//没有指定模式时使用def，非stale模式下忽略MaxStale，使相同含义的查询共用同一个监控
+func (c Consistency) resolve(def Consistency) Consistency {
+	if c.Mode == "" {
+		c = def
+	}
+	if c.Mode == "" {
+		c.Mode = ConsistencyDefault
+	}
+	if c.Mode != ConsistencyStale {
+		c.MaxStale = 0
+	}
+	return c
+}
+
+//设置http查询参数
+func (c Consistency) setParams(params url.Values) {
+	switch c.Mode {
+	case ConsistencyStale:
+		params.Set("stale", "")
+		if c.MaxStale > 0 {
+			params.Set("max_stale", c.MaxStale.String())
+		}
+	case ConsistencyConsistent:
+		params.Set("consistent", "")
+	case ConsistencyCached:
+		params.Set("cached", "")
+	}
+}
+
+//stale模式下处理请求的server与leader失联的时间是否超过了MaxStale
+func (c Consistency) TooStale(lastContact time.Duration) bool {
+	return c.Mode == ConsistencyStale && c.MaxStale > 0 && lastContact > c.MaxStale
+}
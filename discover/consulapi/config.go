@@ -0,0 +1,78 @@
+package consulapi
+
+import (
+	"context"
+	"github.com/hashicorp/consul/api"
+	"gomicro-discover/discover"
+	"strconv"
+	"time"
+)
+
+//依赖consul api的客户端和配置，只需要服务发现的程序使用discover.NewHTTPDiscoverClient即可，
+//不需要引入consul api
+
+//根据服务发现客户端的配置项创建consul api的配置，用于选主、配置中心等直接使用consul api的功能
+func NewConsulConfig(consulHost string, consulPort int, opts ...discover.ClientOption) (*api.Config, error) {
+	config, err := discover.NewClientConfig(opts...)
+	if err != nil {
+		return nil, err
+	}
+	return newConsulConfig(consulHost, consulPort, config), nil
+}
+
+func newConsulConfig(host string, port int, clientConfig *discover.ClientConfig) *api.Config {
+	config := api.DefaultConfig()
+	config.Address = host + ":" + strconv.Itoa(port)
+	config.Scheme = clientConfig.Scheme()
+	config.Token = clientConfig.Token
+	if tlsConfig := clientConfig.TLS; tlsConfig != nil {
+		config.TLSConfig = api.TLSConfig{
+			Address:            tlsConfig.ServerName,
+			CAFile:             tlsConfig.CAFile,
+			CertFile:           tlsConfig.CertFile,
+			KeyFile:            tlsConfig.KeyFile,
+			InsecureSkipVerify: tlsConfig.InsecureSkipVerify,
+		}
+		if config.TLSConfig.Address == "" {
+			config.TLSConfig.Address = host
+		}
+	}
+	return config
+}
+
+//设置consul api的查询参数，api不支持max_stale，由调用方检查LastContact
+func setQueryOptions(c discover.Consistency, options *api.QueryOptions) {
+	switch c.Mode {
+	case discover.ConsistencyStale:
+		options.AllowStale = true
+	case discover.ConsistencyConsistent:
+		options.RequireConsistent = true
+	case discover.ConsistencyCached:
+		options.UseCache = true
+	}
+}
+
+//在ctx的控制下执行不支持context的consul调用
+func callWithContext(ctx context.Context, fn func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- fn()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+//consul要求的时间格式，为0时返回空字符串
+func durationString(d time.Duration) string {
+	if d <= 0 {
+		return ""
+	}
+	return d.String()
+}
@@ -0,0 +1,277 @@
+package consulapi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/go-kit/kit/sd/consul"
+	"github.com/hashicorp/consul/api"
+	"gomicro-discover/discover"
+	"log"
+	"sync"
+	"time"
+)
+
+//注销调用方放弃的注册的超时时间
+const abandonedDeregisterTimeout = 10 * time.Second
+
+type kitDiscoverClient struct {
+	Host   string //consul host
+	Port   int    //consul port
+	client consul.Client
+	//consul原生客户端，用于kit未封装的接口
+	apiClient *api.Client
+	//按服务名管理的watch及缓存
+	watches *discover.WatchSet
+	//TTL模式下的心跳
+	heartbeats discover.Heartbeats
+
+	mutex sync.Mutex
+	//每个实例最近一次注册的序号，用于判断放弃的注册完成时是否已有新的注册
+	registrations map[string]uint64
+}
+
+func NewKitDiscoverClient(consulHost string, consulPort int, opts ...discover.ClientOption) (discover.Client, error) {
+	config, err := discover.NewClientConfig(opts...)
+	if err != nil {
+		return nil, err
+	}
+	//创建consul.client
+	apiClient, err := api.NewClient(newConsulConfig(consulHost, consulPort, config))
+	if err != nil {
+		return nil, err
+	}
+	client := consul.NewClient(apiClient)
+	consulClient := &kitDiscoverClient{
+		Host:          consulHost,
+		Port:          consulPort,
+		client:        client,
+		apiClient:     apiClient,
+		registrations: make(map[string]uint64),
+	}
+	consulClient.watches = discover.NewWatchSet(consulClient.fetch, config)
+	return consulClient, nil
+}
+
+//基于kit的consul服务注册
+func (consulClient *kitDiscoverClient) Register(ctx context.Context, registration *discover.Registration) error {
+	if err := registration.Validate(); err != nil {
+		return err
+	}
+	checks := registration.EffectiveChecks()
+	weights := registration.EffectiveWeights()
+	//构建服务实例元数据
+	serviceRegistration := &api.AgentServiceRegistration{
+		ID:      registration.InstanceId,
+		Name:    registration.ServiceName,
+		Address: registration.InstanceHost,
+		Port:    registration.InstancePort,
+		Meta:    registration.Meta,
+		Tags:    registration.Tags,
+		Weights: &api.AgentWeights{
+			Passing: weights.Passing,
+			Warning: weights.Warning,
+		},
+	}
+	for _, check := range checks {
+		serviceRegistration.Checks = append(serviceRegistration.Checks, &api.AgentServiceCheck{
+			CheckID:                        check.ID,
+			Name:                           check.Name,
+			HTTP:                           check.HTTP,
+			Method:                         check.Method,
+			Header:                         check.Header,
+			TLSSkipVerify:                  check.TLSSkipVerify,
+			TCP:                            check.TCP,
+			GRPC:                           check.GRPC,
+			GRPCUseTLS:                     check.GRPCUseTLS,
+			TTL:                            durationString(check.TTL),
+			Interval:                       durationString(check.Interval),
+			Timeout:                        durationString(check.Timeout),
+			DeregisterCriticalServiceAfter: durationString(check.DeregisterCriticalServiceAfter),
+		})
+	}
+	if err := ctx.Err(); err != nil {
+		return discover.WrapConsulError(err)
+	}
+	//向consul中发送服务注册
+	consulClient.mutex.Lock()
+	consulClient.registrations[registration.InstanceId]++
+	generation := consulClient.registrations[registration.InstanceId]
+	consulClient.mutex.Unlock()
+	done := make(chan error, 1)
+	go func() {
+		done <- consulClient.client.Register(serviceRegistration)
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			return discover.WrapConsulError(err)
+		}
+	case <-ctx.Done():
+		//consul/api的注册接口不支持context，返回之后注册仍可能成功，这时需要注销它，否则会留下没有心跳的实例
+		go consulClient.deregisterAbandoned(registration.InstanceId, generation, done)
+		return discover.WrapConsulError(ctx.Err())
+	}
+	//为TTL检查启动心跳
+	consulClient.heartbeats.Register(registration.InstanceId, checks, registration.HealthCheck, consulClient.updateTTL)
+	return nil
+}
+
+//等待调用方放弃的注册完成，注册成功且之后没有再次注册该实例时将其注销
+func (consulClient *kitDiscoverClient) deregisterAbandoned(instanceId string, generation uint64, done <-chan error) {
+	if err := <-done; err != nil {
+		return
+	}
+	//注销完成之前阻塞新的注册，避免新的注册先于注销到达consul
+	consulClient.mutex.Lock()
+	defer consulClient.mutex.Unlock()
+	if consulClient.registrations[instanceId] != generation {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), abandonedDeregisterTimeout)
+	defer cancel()
+	err := callWithContext(ctx, func() error {
+		return consulClient.client.Deregister(&api.AgentServiceRegistration{ID: instanceId})
+	})
+	if err != nil {
+		log.Printf("deregister abandoned registration of %s failed: %v", instanceId, err)
+	}
+}
+
+//更新TTL检查的状态
+func (consulClient *kitDiscoverClient) updateTTL(ctx context.Context, checkId, status, output string) error {
+	err := callWithContext(ctx, func() error {
+		return consulClient.apiClient.Agent().UpdateTTL(checkId, output, status)
+	})
+	return discover.WrapConsulError(err)
+}
+
+//基于kit的consul服务注销
+func (consulClient *kitDiscoverClient) Deregister(ctx context.Context, instanceId string) error {
+	//停止心跳
+	consulClient.heartbeats.Stop(instanceId)
+	//构建包含服务实例id的元数据结构体
+	serviceRegistrion := &api.AgentServiceRegistration{
+		ID: instanceId,
+	}
+	//向consul发送服务注销
+	err := callWithContext(ctx, func() error {
+		return consulClient.client.Deregister(serviceRegistrion)
+	})
+	return discover.WrapConsulError(err)
+}
+
+//通过本地agent的/v1/agent/service接口判断服务实例是否仍注册在agent上，不经过缓存
+func (consulClient *kitDiscoverClient) Registered(ctx context.Context, instanceId string) (bool, error) {
+	_, _, err := consulClient.apiClient.Agent().Service(instanceId, (&api.QueryOptions{}).WithContext(ctx))
+	if err = discover.WrapConsulError(err); errors.Is(err, discover.ErrServiceNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (consulClient *kitDiscoverClient) SetMaintenance(ctx context.Context, instanceId string, enable bool, reason string) error {
+	err := callWithContext(ctx, func() error {
+		if enable {
+			return consulClient.apiClient.Agent().EnableServiceMaintenance(instanceId, reason)
+		}
+		return consulClient.apiClient.Agent().DisableServiceMaintenance(instanceId)
+	})
+	return discover.WrapConsulError(err)
+}
+
+//查询集群的leader，没有leader时consul无法处理写请求，视为不可用
+func (consulClient *kitDiscoverClient) Ping(ctx context.Context) error {
+	var leader string
+	err := callWithContext(ctx, func() (err error) {
+		leader, err = consulClient.apiClient.Status().Leader()
+		return err
+	})
+	if err != nil {
+		return discover.WrapConsulError(err)
+	}
+	if leader == "" {
+		return fmt.Errorf("%w: no cluster leader", discover.ErrRegistryUnavailable)
+	}
+	return nil
+}
+
+//基于kit的consul服务发现
+func (consulClient *kitDiscoverClient) DiscoverService(ctx context.Context, serviceName string, opts ...discover.QueryOption) ([]*discover.ServiceInstance, error) {
+	return consulClient.watches.Discover(ctx, serviceName, opts...)
+}
+
+//基于kit的consul服务订阅，直接使用watch推送的变化
+func (consulClient *kitDiscoverClient) Subscribe(ctx context.Context, serviceName string, opts ...discover.QueryOption) (<-chan discover.Event, error) {
+	return consulClient.watches.Subscribe(ctx, serviceName, opts...)
+}
+
+//列出正在运行的watch
+func (consulClient *kitDiscoverClient) Watches() []discover.WatchInfo {
+	return consulClient.watches.List()
+}
+
+//停止全部watch和心跳
+func (consulClient *kitDiscoverClient) Close() error {
+	consulClient.watches.Close()
+	consulClient.heartbeats.StopAll()
+	return nil
+}
+
+//根据服务名请求服务实例列表，index大于0时为阻塞查询。
+//stale模式下处理请求的server与leader失联超过MaxStale时，改由leader重新查询一次
+func (consulClient *kitDiscoverClient) fetch(ctx context.Context, key discover.WatchKey, index uint64) ([]*discover.ServiceInstance, discover.ResponseMeta, error) {
+	queryOptions := &api.QueryOptions{Datacenter: key.Datacenter, WaitIndex: index}
+	setQueryOptions(key.Consistency, queryOptions)
+	entries, meta, err := consulClient.client.Service(key.ServiceName, "", false, queryOptions.WithContext(ctx))
+	if err == nil && key.Consistency.TooStale(meta.LastContact) {
+		queryOptions = &api.QueryOptions{Datacenter: key.Datacenter}
+		entries, meta, err = consulClient.client.Service(key.ServiceName, "", false, queryOptions.WithContext(ctx))
+	}
+	if err != nil {
+		return nil, discover.ResponseMeta{}, discover.WrapConsulError(err)
+	}
+	return instancesFromEntries(entries, key.Datacenter), discover.ResponseMeta{
+		Index:       meta.LastIndex,
+		LastContact: meta.LastContact,
+		KnownLeader: meta.KnownLeader,
+	}, nil
+}
+
+//将consul返回的服务列表转换为可用的ServiceInstance列表
+func instancesFromEntries(entries []*api.ServiceEntry, dc string) []*discover.ServiceInstance {
+	instances := make([]*discover.ServiceInstance, len(entries))
+	for i := 0; i < len(instances); i++ {
+		instances[i] = instanceFromEntry(entries[i])
+		if instances[i].Datacenter == "" {
+			instances[i].Datacenter = dc
+		}
+	}
+	return discover.HealthyInstances(instances)
+}
+
+//将consul api返回的ServiceEntry转换为ServiceInstance
+func instanceFromEntry(entry *api.ServiceEntry) *discover.ServiceInstance {
+	instance := &discover.ServiceInstance{
+		ID:          entry.Service.ID,
+		ServiceName: entry.Service.Service,
+		Address:     entry.Service.Address,
+		Port:        entry.Service.Port,
+		Tags:        entry.Service.Tags,
+		Meta:        entry.Service.Meta,
+		Weights: discover.Weights{
+			Passing: entry.Service.Weights.Passing,
+			Warning: entry.Service.Weights.Warning,
+		},
+		Status: entry.Checks.AggregatedStatus(),
+	}
+	if entry.Node != nil {
+		instance.Node = entry.Node.Node
+		instance.Datacenter = entry.Node.Datacenter
+		//服务没有单独设置地址时使用节点地址
+		if instance.Address == "" {
+			instance.Address = entry.Node.Address
+		}
+	}
+	return instance
+}
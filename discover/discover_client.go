@@ -1,6 +1,10 @@
 package discover
 
-import "log"
+import (
+	"context"
+	"log"
+	"time"
+)
 
 //用于与consul交互的接口
 
@@ -29,3 +33,140 @@ type DiscoveryClient interface {
 	*/
 	DiscoverService(serviceName string, logger *log.Logger) []interface{}
 }
+
+//支持context并返回错误的服务发现客户端接口，HTTPDiscoverClient和consulapi包的kitDiscoverClient均实现了该接口
+//旧的DiscoveryClient接口可以通过NewLegacyClient适配得到
+
+type Client interface {
+
+	/**
+	服务注册接口
+	@param registration 服务注册信息
+	注册信息不完整时返回ErrInvalidRegistration，consul不可用时返回ErrRegistryUnavailable
+	*/
+	Register(ctx context.Context, registration *Registration) error
+
+	/**
+	服务注销接口
+	@param instanceId 服务实例Id
+	*/
+	Deregister(ctx context.Context, instanceId string) error
+
+	/**
+	服务发现接口
+	@param serviceName 服务名
+	@param opts 查询条件，如标签和元数据过滤
+	没有满足条件的可用服务实例时返回ErrServiceNotFound
+	*/
+	DiscoverService(ctx context.Context, serviceName string, opts ...QueryOption) ([]*ServiceInstance, error)
+
+	/**
+	订阅服务实例变化接口
+	@param serviceName 服务名
+	@param opts 订阅的数据中心和一致性模式，标签、元数据和故障转移不适用于订阅，需要时使用FilterInstances过滤推送的实例
+	订阅后立即推送一次当前的实例列表，之后在实例列表变化时推送，ctx结束后关闭返回的channel
+	*/
+	Subscribe(ctx context.Context, serviceName string, opts ...QueryOption) (<-chan Event, error)
+
+	/**
+	关闭客户端，停止全部后台监控，之后的查询和订阅返回ErrClientClosed
+	*/
+	Close() error
+}
+
+//可以查询服务实例是否仍注册在本地agent上的客户端，HTTPDiscoverClient和consulapi包的kitDiscoverClient均实现了该接口，
+//Registrar使用它发现agent重启等原因丢失的注册
+type RegistrationChecker interface {
+
+	/**
+	查询服务实例是否已注册
+	@param instanceId 服务实例Id
+	*/
+	Registered(ctx context.Context, instanceId string) (bool, error)
+}
+
+//可以将服务实例置为维护模式的客户端，HTTPDiscoverClient和consulapi包的kitDiscoverClient均实现了该接口，
+//维护模式下的实例不会被服务发现返回，用于优雅退出前摘除流量
+type MaintenanceSetter interface {
+
+	/**
+	开启或关闭服务实例的维护模式
+	@param instanceId 服务实例Id
+	@param enable 是否开启
+	@param reason 开启的原因，会显示在consul的检查输出中
+	*/
+	SetMaintenance(ctx context.Context, instanceId string, enable bool, reason string) error
+}
+
+//可以检查consul是否可达的客户端，HTTPDiscoverClient和consulapi包的kitDiscoverClient均实现了该接口，
+//健康检查使用它发现与consul的连接中断
+type Pinger interface {
+
+	/**
+	检查consul是否可达并且集群已经选出leader，不可达时返回ErrRegistryUnavailable
+	*/
+	Ping(ctx context.Context) error
+}
+
+//服务实例变化事件
+type Event struct {
+	Instances []*ServiceInstance //当前全部可用的服务实例
+	Added     []*ServiceInstance //相比上一次推送新增的实例
+	Removed   []*ServiceInstance //相比上一次推送移除的实例
+	Err       error              //监控出错时不为空，此时Instances为最近一次成功获取的数据
+}
+
+//服务注册信息
+type Registration struct {
+	ServiceName    string             //服务名
+	InstanceId     string             //服务实例Id
+	InstanceHost   string             //服务实例地址
+	InstancePort   int                //服务实例端口
+	HealthCheckUrl string             //健康检查地址
+	Meta           map[string]string  //服务实例元数据
+	Tags           []string           //服务实例标签，可用于服务发现时过滤
+	TTL            time.Duration      //不为0时使用TTL心跳检查代替consul主动发起的HTTP检查
+	HealthCheck    func() bool        //TTL模式下每次心跳前调用，返回false时将检查标记为warning或critical
+	Checks         []*CheckDefinition //健康检查，不为空时忽略HealthCheckUrl和TTL
+	Weights        Weights            //权重，为0的项使用默认值：passing为10，warning为1
+}
+
+//注册时的默认权重
+const (
+	defaultPassingWeight = 10
+	defaultWarningWeight = 1
+)
+
+//注册时实际使用的权重，为0的项使用默认值
+func (r *Registration) EffectiveWeights() Weights {
+	weights := r.Weights
+	if weights.Passing <= 0 {
+		weights.Passing = defaultPassingWeight
+	}
+	if weights.Warning <= 0 {
+		weights.Warning = defaultWarningWeight
+	}
+	return weights
+}
+
+//校验注册信息是否完整
+func (r *Registration) Validate() error {
+	if r == nil {
+		return ErrInvalidRegistration
+	}
+	if r.ServiceName == "" || r.InstanceId == "" || r.InstanceHost == "" {
+		return ErrInvalidRegistration
+	}
+	if r.InstancePort <= 0 || r.InstancePort > 65535 {
+		return ErrInvalidRegistration
+	}
+	for _, check := range r.Checks {
+		if check == nil {
+			return ErrInvalidRegistration
+		}
+		if err := check.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
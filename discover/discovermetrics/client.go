@@ -0,0 +1,169 @@
+package discovermetrics
+
+import (
+	"context"
+	"errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"gomicro-discover/discover"
+	"time"
+)
+
+//为discover.Client记录prometheus指标的装饰器：注册、注销、服务发现的调用次数和耗时，
+//缓存命中情况，以及抓取时从WatchLister读取的监控数量、监控更新时间和各服务的可用实例数
+
+//不在WithServices中的服务的缓存命中情况和监控状态记录在该service标签下
+const OtherService = "other"
+
+//调用的结果，用作outcome标签
+const (
+	OutcomeSuccess          = "success"
+	OutcomeNotFound         = "not_found"
+	OutcomeInvalid          = "invalid"
+	OutcomePermissionDenied = "permission_denied"
+	OutcomeUnavailable      = "unavailable"
+	OutcomeClosed           = "closed"
+	OutcomeCanceled         = "canceled"
+	OutcomeError            = "error"
+)
+
+//错误对应的outcome标签
+func Outcome(err error) string {
+	switch {
+	case err == nil:
+		return OutcomeSuccess
+	case errors.Is(err, discover.ErrServiceNotFound):
+		return OutcomeNotFound
+	case errors.Is(err, discover.ErrInvalidRegistration):
+		return OutcomeInvalid
+	case errors.Is(err, discover.ErrPermissionDenied):
+		return OutcomePermissionDenied
+	case errors.Is(err, discover.ErrRegistryUnavailable):
+		return OutcomeUnavailable
+	case errors.Is(err, discover.ErrClientClosed):
+		return OutcomeClosed
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return OutcomeCanceled
+	default:
+		return OutcomeError
+	}
+}
+
+//记录指标的装饰器，通过NewClient创建
+type Client struct {
+	next discover.Client
+	//缓存命中情况按服务名记录的服务，服务名可能来自外部请求，不能直接用作标签
+	services map[string]bool
+
+	requests    *prometheus.CounterVec
+	duration    *prometheus.HistogramVec
+	cacheHits   *prometheus.CounterVec
+	cacheMisses *prometheus.CounterVec
+}
+
+type Option func(*Client)
+
+//缓存命中情况和监控状态按服务名分别记录的服务，其他服务记录为OtherService
+func WithServices(names ...string) Option {
+	return func(c *Client) {
+		for _, name := range names {
+			c.services[name] = true
+		}
+	}
+}
+
+//创建装饰器，registerer为nil时使用prometheus.DefaultRegisterer，
+//同一个Registerer只能注册一次，重复注册时返回错误。
+//返回的客户端通过discover.Forward转发next实现的RegistrationChecker、MaintenanceSetter、Pinger、WatchLister接口
+func NewClient(next discover.Client, registerer prometheus.Registerer, opts ...Option) (discover.Client, error) {
+	if registerer == nil {
+		registerer = prometheus.DefaultRegisterer
+	}
+	c := &Client{
+		next:     next,
+		services: make(map[string]bool),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "discovery_client_requests_total",
+			Help: "Number of discovery client calls by method and outcome.",
+		}, []string{"method", "outcome"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "discovery_client_request_duration_seconds",
+			Help:    "Latency of discovery client calls by method.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"method"}),
+		cacheHits: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "discovery_client_cache_hits_total",
+			Help: "Number of service discoveries answered by an existing watch, including failed ones.",
+		}, []string{"service"}),
+		cacheMisses: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "discovery_client_cache_misses_total",
+			Help: "Number of service discoveries that waited for a new watch to complete its first query, including failed ones.",
+		}, []string{"service"}),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	collectors := []prometheus.Collector{c.requests, c.duration, c.cacheHits, c.cacheMisses}
+	if lister, ok := next.(discover.WatchLister); ok {
+		collectors = append(collectors, newWatchCollector(lister, c.serviceLabel))
+	}
+	for _, collector := range collectors {
+		if err := registerer.Register(collector); err != nil {
+			return nil, err
+		}
+	}
+	return discover.Forward(c, next), nil
+}
+
+//服务名对应的service标签，不在WithServices中的服务记录为OtherService
+func (c *Client) serviceLabel(serviceName string) string {
+	if c.services[serviceName] {
+		return serviceName
+	}
+	return OtherService
+}
+
+//记录一次调用
+func (c *Client) observe(method string, start time.Time, err error) {
+	c.requests.WithLabelValues(method, Outcome(err)).Inc()
+	c.duration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+}
+
+func (c *Client) Register(ctx context.Context, registration *discover.Registration) (err error) {
+	defer func(start time.Time) { c.observe("register", start, err) }(time.Now())
+	return c.next.Register(ctx, registration)
+}
+
+func (c *Client) Deregister(ctx context.Context, instanceId string) (err error) {
+	defer func(start time.Time) { c.observe("deregister", start, err) }(time.Now())
+	return c.next.Deregister(ctx, instanceId)
+}
+
+//通过WithQueryMeta获取缓存命中情况，查询失败时同样记录，调用方同样指定了WithQueryMeta时将元信息转写给调用方
+func (c *Client) DiscoverService(ctx context.Context, serviceName string, opts ...discover.QueryOption) (instances []*discover.ServiceInstance, err error) {
+	defer func(start time.Time) { c.observe("discover", start, err) }(time.Now())
+	var options discover.QueryOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+	var meta discover.QueryMeta
+	instances, err = c.next.DiscoverService(ctx, serviceName, append(opts, discover.WithQueryMeta(&meta))...)
+	options.SetQueryMeta(meta)
+	service := c.serviceLabel(serviceName)
+	if meta.Cached {
+		c.cacheHits.WithLabelValues(service).Inc()
+	} else {
+		c.cacheMisses.WithLabelValues(service).Inc()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return instances, nil
+}
+
+func (c *Client) Subscribe(ctx context.Context, serviceName string, opts ...discover.QueryOption) (<-chan discover.Event, error) {
+	return c.next.Subscribe(ctx, serviceName, opts...)
+}
+
+func (c *Client) Close() error {
+	return c.next.Close()
+}
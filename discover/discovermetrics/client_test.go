@@ -0,0 +1,141 @@
+package discovermetrics_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"gomicro-discover/discover"
+	"gomicro-discover/discover/discovermetrics"
+	"gomicro-discover/discover/discovertest"
+	"testing"
+	"time"
+)
+
+//只实现了discover.Client的客户端
+type basicClient struct {
+	discover.Client
+}
+
+//被装饰的客户端不支持的可选接口不会被实现，避免Registrar不再重新注册、就绪检查总是认为consul可达
+func TestForwardsOnlySupportedInterfaces(t *testing.T) {
+	ctx := context.Background()
+	client, err := discovermetrics.NewClient(basicClient{discovertest.NewClient()}, prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := client.(discover.RegistrationChecker); ok {
+		t.Fatal("client implements RegistrationChecker")
+	}
+	if _, ok := client.(discover.Pinger); ok {
+		t.Fatal("client implements Pinger")
+	}
+	if _, ok := client.(discover.WatchLister); ok {
+		t.Fatal("client implements WatchLister")
+	}
+	setter, ok := client.(discover.MaintenanceSetter)
+	if !ok {
+		t.Fatal("client does not implement MaintenanceSetter")
+	}
+	if err := setter.SetMaintenance(ctx, "string-1", true, ""); !errors.Is(err, discover.ErrMaintenanceUnsupported) {
+		t.Fatalf("SetMaintenance() = %v, want ErrMaintenanceUnsupported", err)
+	}
+
+	next := discovertest.NewClient()
+	client, err = discovermetrics.NewClient(next, prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	checker, ok := client.(discover.RegistrationChecker)
+	if !ok {
+		t.Fatal("client does not implement RegistrationChecker")
+	}
+	if registered, err := checker.Registered(ctx, "string-1"); err != nil || registered {
+		t.Fatalf("Registered() = %v, %v, want false", registered, err)
+	}
+	pinger, ok := client.(discover.Pinger)
+	if !ok {
+		t.Fatal("client does not implement Pinger")
+	}
+	errPing := errors.New("consul unreachable")
+	next.SetError(discovertest.OpPing, errPing)
+	if err := pinger.Ping(ctx); err != errPing {
+		t.Fatalf("Ping() = %v, want %v", err, errPing)
+	}
+}
+
+//不在WithServices中的服务记录为other，查询失败时同样记录缓存命中情况
+func TestCacheServiceLabel(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	server := discovertest.NewConsulServer()
+	defer server.Close()
+	next, err := discover.NewHTTPDiscoverClient(server.Host(), server.Port())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer next.Close()
+	registry := prometheus.NewRegistry()
+	client, err := discovermetrics.NewClient(next, registry, discovermetrics.WithServices("string"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := client.(discover.WatchLister); !ok {
+		t.Fatal("client does not implement WatchLister")
+	}
+	if err := client.Register(ctx, &discover.Registration{
+		ServiceName:  "string",
+		InstanceId:   "string-1",
+		InstanceHost: "127.0.0.1",
+		InstancePort: 10085,
+	}); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := client.DiscoverService(ctx, "string"); err != nil {
+			t.Fatalf("discover: %v", err)
+		}
+	}
+	for _, name := range []string{"unknown-1", "unknown-1", "unknown-2"} {
+		if _, err := client.DiscoverService(ctx, name); !errors.Is(err, discover.ErrServiceNotFound) {
+			t.Fatalf("discover %s: err = %v, want ErrServiceNotFound", name, err)
+		}
+	}
+
+	//只有两个service标签，服务名不会无限增长
+	assertCounters(t, registry, "discovery_client_cache_hits_total", map[string]float64{"string": 1, discovermetrics.OtherService: 1})
+	assertCounters(t, registry, "discovery_client_cache_misses_total", map[string]float64{"string": 1, discovermetrics.OtherService: 2})
+	//两个未知服务的监控合并为一个序列
+	assertCounters(t, registry, "discovery_client_healthy_instances", map[string]float64{"string": 1, discovermetrics.OtherService: 0})
+	assertCounters(t, registry, "discovery_client_watch_failing", map[string]float64{"string": 0, discovermetrics.OtherService: 0})
+}
+
+//按service标签比较计数器或gauge的值，同一个service标签出现多次时测试失败
+func assertCounters(t *testing.T, registry *prometheus.Registry, name string, want map[string]float64) {
+	t.Helper()
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]float64)
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() != "service" {
+					continue
+				}
+				if _, ok := got[label.GetValue()]; ok {
+					t.Fatalf("%s has duplicate series for service %s", name, label.GetValue())
+				}
+				got[label.GetValue()] = metric.GetCounter().GetValue() + metric.GetGauge().GetValue()
+			}
+		}
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("%s = %v, want %v", name, got, want)
+	}
+}
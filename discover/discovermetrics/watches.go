@@ -0,0 +1,89 @@
+package discovermetrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"gomicro-discover/discover"
+	"time"
+)
+
+//抓取时读取正在运行的监控生成的指标，监控被停止后对应的序列随之消失。
+//服务名可能来自外部请求，通过serviceLabel映射后标签相同的监控合并为一个序列
+
+var watchLabels = []string{"service", "datacenter", "consistency"}
+
+var (
+	watchesDesc = prometheus.NewDesc(
+		"discovery_client_watches",
+		"Number of active service watches.",
+		nil, nil)
+	watchAgeDesc = prometheus.NewDesc(
+		"discovery_client_watch_last_update_age_seconds",
+		"Seconds since the watch last completed a query against consul, or since the snapshot it was restored from, taking the stalest of the watches sharing the labels. Blocking queries return at least once per wait time, so larger values mean the watch is stale.",
+		watchLabels, nil)
+	watchFailingDesc = prometheus.NewDesc(
+		"discovery_client_watch_failing",
+		"Whether the latest query of any watch sharing the labels failed, 1 if it did.",
+		watchLabels, nil)
+	healthyInstancesDesc = prometheus.NewDesc(
+		"discovery_client_healthy_instances",
+		"Number of passing instances of the watched service, summed over the watches sharing the labels.",
+		watchLabels, nil)
+)
+
+type watchCollector struct {
+	lister       discover.WatchLister
+	serviceLabel func(serviceName string) string
+}
+
+//标签相同的监控合并后的值
+type watchSeries struct {
+	labels     []string
+	lastUpdate time.Time //最早的更新时间，即最久没有更新的监控，没有获取过数据的监控不参与
+	failing    bool      //任一监控的最近一次查询失败
+	instances  int       //可用实例数之和
+}
+
+func newWatchCollector(lister discover.WatchLister, serviceLabel func(serviceName string) string) *watchCollector {
+	return &watchCollector{lister: lister, serviceLabel: serviceLabel}
+}
+
+func (w *watchCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- watchesDesc
+	ch <- watchAgeDesc
+	ch <- watchFailingDesc
+	ch <- healthyInstancesDesc
+}
+
+func (w *watchCollector) Collect(ch chan<- prometheus.Metric) {
+	watches := w.lister.Watches()
+	ch <- prometheus.MustNewConstMetric(watchesDesc, prometheus.GaugeValue, float64(len(watches)))
+	var series []*watchSeries
+	index := make(map[[3]string]*watchSeries)
+	for _, info := range watches {
+		key := [3]string{w.serviceLabel(info.ServiceName), info.Datacenter, info.Consistency}
+		s, ok := index[key]
+		if !ok {
+			s = &watchSeries{labels: key[:]}
+			index[key] = s
+			series = append(series, s)
+		}
+		if !info.LastUpdate.IsZero() && (s.lastUpdate.IsZero() || info.LastUpdate.Before(s.lastUpdate)) {
+			s.lastUpdate = info.LastUpdate
+		}
+		s.failing = s.failing || info.Error != ""
+		s.instances += info.Instances
+	}
+	now := time.Now()
+	for _, s := range series {
+		//还没有获取过数据的监控没有更新时间
+		if !s.lastUpdate.IsZero() {
+			ch <- prometheus.MustNewConstMetric(watchAgeDesc, prometheus.GaugeValue, now.Sub(s.lastUpdate).Seconds(), s.labels...)
+		}
+		failing := 0.0
+		if s.failing {
+			failing = 1
+		}
+		ch <- prometheus.MustNewConstMetric(watchFailingDesc, prometheus.GaugeValue, failing, s.labels...)
+		ch <- prometheus.MustNewConstMetric(healthyInstancesDesc, prometheus.GaugeValue, float64(s.instances), s.labels...)
+	}
+}
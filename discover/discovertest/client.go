@@ -0,0 +1,387 @@
+package discovertest
+
+import (
+	"context"
+	"gomicro-discover/discover"
+	"sort"
+	"sync"
+)
+
+//内存中的服务发现客户端，实例列表、健康状态和调用失败都可以由测试代码控制，
+//用于测试依赖discover.Client的代码而不需要启动consul
+
+//可以注入失败的操作
+type Op string
+
+const (
+	OpRegister        Op = "Register"
+	OpDeregister      Op = "Deregister"
+	OpDiscoverService Op = "DiscoverService"
+	OpSubscribe       Op = "Subscribe"
+	OpRegistered      Op = "Registered"
+	OpMaintenance     Op = "SetMaintenance"
+	OpPing            Op = "Ping"
+)
+
+type Client struct {
+	//本地数据中心，Datacenter为空的实例属于本地数据中心
+	Datacenter string
+
+	mutex sync.Mutex
+	//按服务名、实例ID保存的服务实例
+	services map[string]map[string]*discover.ServiceInstance
+	//通过Register注册的信息
+	registrations map[string]*discover.Registration
+	//持续返回的错误
+	errs map[Op]error
+	//只返回一次的错误
+	nextErrs map[Op][]error
+	//每个操作的调用次数
+	calls map[Op]int
+	//订阅者，按服务名分组
+	subscribers map[string]map[chan struct{}]struct{}
+	closed      bool
+	done        chan struct{}
+}
+
+func NewClient() *Client {
+	return &Client{
+		Datacenter:    "dc1",
+		services:      make(map[string]map[string]*discover.ServiceInstance),
+		registrations: make(map[string]*discover.Registration),
+		errs:          make(map[Op]error),
+		nextErrs:      make(map[Op][]error),
+		calls:         make(map[Op]int),
+		subscribers:   make(map[string]map[chan struct{}]struct{}),
+		done:          make(chan struct{}),
+	}
+}
+
+//替换服务的全部实例，实例的ServiceName为空时使用serviceName，Status为空时视为passing
+func (c *Client) SetInstances(serviceName string, instances ...*discover.ServiceInstance) {
+	c.mutex.Lock()
+	service := make(map[string]*discover.ServiceInstance, len(instances))
+	for _, instance := range instances {
+		service[instance.ID] = c.normalize(serviceName, instance)
+	}
+	c.services[serviceName] = service
+	c.mutex.Unlock()
+	c.notify(serviceName)
+}
+
+//新增或替换服务的一个实例
+func (c *Client) AddInstance(serviceName string, instance *discover.ServiceInstance) {
+	c.mutex.Lock()
+	c.service(serviceName)[instance.ID] = c.normalize(serviceName, instance)
+	c.mutex.Unlock()
+	c.notify(serviceName)
+}
+
+//移除服务的一个实例
+func (c *Client) RemoveInstance(serviceName, instanceId string) {
+	c.mutex.Lock()
+	delete(c.service(serviceName), instanceId)
+	c.mutex.Unlock()
+	c.notify(serviceName)
+}
+
+//修改实例的健康状态，非passing和warning的实例不会被查询到
+func (c *Client) SetStatus(serviceName, instanceId, status string) {
+	c.mutex.Lock()
+	if instance, ok := c.service(serviceName)[instanceId]; ok {
+		//复制一份，避免修改已经返回给调用方的实例
+		updated := *instance
+		updated.Status = status
+		c.services[serviceName][instanceId] = &updated
+	}
+	c.mutex.Unlock()
+	c.notify(serviceName)
+}
+
+//使某个操作持续返回err，err为nil时恢复正常
+func (c *Client) SetError(op Op, err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if err == nil {
+		delete(c.errs, op)
+		return
+	}
+	c.errs[op] = err
+}
+
+//使某个操作的下一次调用返回err，多次调用按顺序依次返回
+func (c *Client) FailNext(op Op, err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.nextErrs[op] = append(c.nextErrs[op], err)
+}
+
+//操作被调用的次数
+func (c *Client) Calls(op Op) int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.calls[op]
+}
+
+//通过Register注册且尚未注销的信息
+func (c *Client) Registration(instanceId string) (*discover.Registration, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	registration, ok := c.registrations[instanceId]
+	return registration, ok
+}
+
+//注册信息会同时生成一个passing状态的服务实例
+func (c *Client) Register(ctx context.Context, registration *discover.Registration) error {
+	if err := c.call(ctx, OpRegister); err != nil {
+		return err
+	}
+	if err := registration.Validate(); err != nil {
+		return err
+	}
+	c.mutex.Lock()
+	c.registrations[registration.InstanceId] = registration
+	c.service(registration.ServiceName)[registration.InstanceId] = &discover.ServiceInstance{
+		ID:          registration.InstanceId,
+		ServiceName: registration.ServiceName,
+		Address:     registration.InstanceHost,
+		Port:        registration.InstancePort,
+		Tags:        registration.Tags,
+		Meta:        registration.Meta,
+		Weights:     registration.EffectiveWeights(),
+		Status:      discover.HealthPassing,
+		Datacenter:  c.Datacenter,
+	}
+	c.mutex.Unlock()
+	c.notify(registration.ServiceName)
+	return nil
+}
+
+func (c *Client) Deregister(ctx context.Context, instanceId string) error {
+	if err := c.call(ctx, OpDeregister); err != nil {
+		return err
+	}
+	c.mutex.Lock()
+	registration, ok := c.registrations[instanceId]
+	delete(c.registrations, instanceId)
+	c.mutex.Unlock()
+	if !ok {
+		return discover.ErrServiceNotFound
+	}
+	c.RemoveInstance(registration.ServiceName, instanceId)
+	return nil
+}
+
+//实现discover.RegistrationChecker，可以通过Deregister或RemoveInstance模拟注册丢失
+func (c *Client) Registered(ctx context.Context, instanceId string) (bool, error) {
+	if err := c.call(ctx, OpRegistered); err != nil {
+		return false, err
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	registration, ok := c.registrations[instanceId]
+	if !ok {
+		return false, nil
+	}
+	_, ok = c.service(registration.ServiceName)[instanceId]
+	return ok, nil
+}
+
+//实现discover.MaintenanceSetter，开启时实例状态变为maintenance，关闭时恢复为passing
+func (c *Client) SetMaintenance(ctx context.Context, instanceId string, enable bool, reason string) error {
+	if err := c.call(ctx, OpMaintenance); err != nil {
+		return err
+	}
+	c.mutex.Lock()
+	registration, ok := c.registrations[instanceId]
+	c.mutex.Unlock()
+	if !ok {
+		return discover.ErrServiceNotFound
+	}
+	status := discover.HealthPassing
+	if enable {
+		status = discover.HealthMaintenance
+	}
+	c.SetStatus(registration.ServiceName, instanceId, status)
+	return nil
+}
+
+//实现discover.Pinger，可以通过SetError(OpPing, ...)模拟consul不可达
+func (c *Client) Ping(ctx context.Context) error {
+	return c.call(ctx, OpPing)
+}
+
+func (c *Client) DiscoverService(ctx context.Context, serviceName string, opts ...discover.QueryOption) ([]*discover.ServiceInstance, error) {
+	if err := c.call(ctx, OpDiscoverService); err != nil {
+		return nil, err
+	}
+	c.mutex.Lock()
+	instances := c.healthy(serviceName)
+	c.mutex.Unlock()
+	//与真实客户端一致，依次查询指定的数据中心和故障转移的数据中心
+	options := discover.NewQueryOptions(opts...)
+	for _, dc := range options.Datacenters() {
+		if dc == "" {
+			dc = c.Datacenter
+		}
+		if matched, err := discover.FilterInstances(inDatacenter(instances, dc), opts...); err == nil {
+			return matched, nil
+		}
+	}
+	return nil, discover.ErrServiceNotFound
+}
+
+//订阅后立即推送一次指定数据中心（为空时为本地数据中心）的实例列表，之后每次修改实例时推送
+func (c *Client) Subscribe(ctx context.Context, serviceName string, opts ...discover.QueryOption) (<-chan discover.Event, error) {
+	if err := c.call(ctx, OpSubscribe); err != nil {
+		return nil, err
+	}
+	dc := discover.NewQueryOptions(opts...).Datacenter
+	if dc == "" {
+		dc = c.Datacenter
+	}
+	notify := make(chan struct{}, 1)
+	notify <- struct{}{}
+	c.mutex.Lock()
+	if c.subscribers[serviceName] == nil {
+		c.subscribers[serviceName] = make(map[chan struct{}]struct{})
+	}
+	c.subscribers[serviceName][notify] = struct{}{}
+	c.mutex.Unlock()
+
+	out := make(chan discover.Event, 1)
+	go func() {
+		defer close(out)
+		defer func() {
+			c.mutex.Lock()
+			delete(c.subscribers[serviceName], notify)
+			c.mutex.Unlock()
+		}()
+		var (
+			last []*discover.ServiceInstance
+			sent bool
+		)
+		for {
+			select {
+			case <-notify:
+			case <-c.done:
+				return
+			case <-ctx.Done():
+				return
+			}
+			c.mutex.Lock()
+			instances := inDatacenter(c.healthy(serviceName), dc)
+			c.mutex.Unlock()
+			added, removed, changed := discover.DiffInstances(last, instances)
+			if sent && !changed {
+				continue
+			}
+			select {
+			case out <- discover.Event{Instances: instances, Added: added, Removed: removed}:
+				last, sent = instances, true
+			case <-c.done:
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out, nil
+}
+
+//数据中心为dc的实例
+func inDatacenter(instances []*discover.ServiceInstance, dc string) []*discover.ServiceInstance {
+	var inDC []*discover.ServiceInstance
+	for _, instance := range instances {
+		if instance.Datacenter == dc {
+			inDC = append(inDC, instance)
+		}
+	}
+	return inDC
+}
+
+//关闭后所有订阅的channel被关闭，之后的调用返回discover.ErrClientClosed
+func (c *Client) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if !c.closed {
+		c.closed = true
+		close(c.done)
+	}
+	return nil
+}
+
+//记录调用次数并返回注入的错误
+func (c *Client) call(ctx context.Context, op Op) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.calls[op]++
+	if c.closed {
+		return discover.ErrClientClosed
+	}
+	if errs := c.nextErrs[op]; len(errs) > 0 {
+		c.nextErrs[op] = errs[1:]
+		return errs[0]
+	}
+	return c.errs[op]
+}
+
+//需要持有锁
+func (c *Client) service(serviceName string) map[string]*discover.ServiceInstance {
+	service, ok := c.services[serviceName]
+	if !ok {
+		service = make(map[string]*discover.ServiceInstance)
+		c.services[serviceName] = service
+	}
+	return service
+}
+
+//返回按ID排序的可用实例，需要持有锁
+func (c *Client) healthy(serviceName string) []*discover.ServiceInstance {
+	instances := make([]*discover.ServiceInstance, 0, len(c.services[serviceName]))
+	for _, instance := range c.services[serviceName] {
+		if instance.Healthy() {
+			instances = append(instances, instance)
+		}
+	}
+	sort.Slice(instances, func(i, j int) bool {
+		return instances[i].ID < instances[j].ID
+	})
+	return instances
+}
+
+func (c *Client) notify(serviceName string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for subscriber := range c.subscribers[serviceName] {
+		select {
+		case subscriber <- struct{}{}:
+		default:
+		}
+	}
+}
+
+//补全实例的默认字段，返回副本
+func (c *Client) normalize(serviceName string, instance *discover.ServiceInstance) *discover.ServiceInstance {
+	copied := *instance
+	if copied.ServiceName == "" {
+		copied.ServiceName = serviceName
+	}
+	if copied.Datacenter == "" {
+		copied.Datacenter = c.Datacenter
+	}
+	if copied.Status == "" {
+		copied.Status = discover.HealthPassing
+	}
+	return &copied
+}
+
+var (
+	_ discover.Client              = (*Client)(nil)
+	_ discover.RegistrationChecker = (*Client)(nil)
+	_ discover.MaintenanceSetter   = (*Client)(nil)
+	_ discover.Pinger              = (*Client)(nil)
+)
@@ -0,0 +1,817 @@
+package discovertest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//基于httptest的consul agent，实现服务注册、注销、TTL检查更新、支持阻塞查询的健康服务查询、KV读写和session锁，
+//HTTPDiscoverClient、consulapi包的kitDiscoverClient、kvconfig和leader都可以直接连接它进行离线的端到端测试。
+//它不会主动执行HTTP检查，除TTL检查初始为critical外，其余检查初始为passing，可以通过SetCheckStatus修改。
+//session不会因TTL过期而失效，也没有lock-delay，可以通过DestroySession模拟session失效
+
+//注册时提交的健康检查，兼容InstanceInfo和api.AgentServiceRegistration的json格式
+type fakeCheck struct {
+	CheckID string `json:"CheckID,omitempty"`
+	Name    string `json:"Name,omitempty"`
+	HTTP    string `json:"HTTP,omitempty"`
+	TCP     string `json:"TCP,omitempty"`
+	GRPC    string `json:"GRPC,omitempty"`
+	TTL     string `json:"TTL,omitempty"`
+	Status  string `json:"Status,omitempty"`
+}
+
+//注册时提交的服务信息
+type fakeService struct {
+	ID      string            `json:"ID"`
+	Name    string            `json:"Name"`
+	Tags    []string          `json:"Tags"`
+	Address string            `json:"Address"`
+	Port    int               `json:"Port"`
+	Meta    map[string]string `json:"Meta"`
+	Weights struct {
+		Passing int `json:"Passing"`
+		Warning int `json:"Warning"`
+	} `json:"Weights"`
+	Check  *fakeCheck   `json:"Check"`
+	Checks []*fakeCheck `json:"Checks"`
+}
+
+//健康检查的当前状态
+type checkState struct {
+	CheckID   string `json:"CheckID"`
+	Name      string `json:"Name"`
+	Status    string `json:"Status"`
+	Output    string `json:"Output"`
+	ServiceID string `json:"ServiceID"`
+}
+
+//KV中保存的配置项
+type kvEntry struct {
+	Key         string `json:"Key"`
+	Value       []byte `json:"Value"`
+	Flags       uint64 `json:"Flags"`
+	CreateIndex uint64 `json:"CreateIndex"`
+	ModifyIndex uint64 `json:"ModifyIndex"`
+	LockIndex   uint64 `json:"LockIndex"`
+	Session     string `json:"Session,omitempty"`
+}
+
+//创建的session
+type fakeSession struct {
+	ID       string `json:"ID"`
+	Name     string `json:"Name"`
+	TTL      string `json:"TTL"`
+	Behavior string `json:"Behavior"`
+}
+
+type ConsulServer struct {
+	*httptest.Server
+	Node       string //返回的节点名
+	Datacenter string //返回的数据中心
+
+	mutex    sync.Mutex
+	index    uint64
+	services map[string]*fakeService
+	checks   map[string]*checkState
+	kv       map[string]*kvEntry
+	sessions map[string]*fakeSession
+	//用于生成session ID
+	sessionSeq int
+	//数据变化时关闭并替换，用于唤醒阻塞查询
+	changed chan struct{}
+	//注入的失败状态码，为0时正常响应
+	failStatus int
+	//注入的处理延迟
+	delay time.Duration
+	//每个路径前缀的请求次数
+	requests map[string]int
+	//stale查询返回的X-Consul-LastContact，模拟与leader失联的follower
+	lastContact time.Duration
+	//最近一次服务实例查询使用的一致性模式
+	lastConsistency string
+}
+
+//启动fake consul agent，使用完毕后需要调用Close
+func NewConsulServer() *ConsulServer {
+	s := &ConsulServer{
+		Node:       "discovertest",
+		Datacenter: "dc1",
+		index:      1,
+		services:   make(map[string]*fakeService),
+		checks:     make(map[string]*checkState),
+		kv:         make(map[string]*kvEntry),
+		sessions:   make(map[string]*fakeSession),
+		changed:    make(chan struct{}),
+		requests:   make(map[string]int),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/agent/service/register", s.handleRegister)
+	mux.HandleFunc("/v1/agent/service/deregister/", s.handleDeregister)
+	mux.HandleFunc("/v1/agent/service/", s.handleAgentService)
+	mux.HandleFunc("/v1/agent/service/maintenance/", s.handleMaintenance)
+	mux.HandleFunc("/v1/agent/check/update/", s.handleCheckUpdate)
+	mux.HandleFunc("/v1/health/service/", s.handleHealthService)
+	mux.HandleFunc("/v1/kv/", s.handleKV)
+	mux.HandleFunc("/v1/session/create", s.handleSessionCreate)
+	mux.HandleFunc("/v1/session/renew/", s.handleSessionRenew)
+	mux.HandleFunc("/v1/session/destroy/", s.handleSessionDestroy)
+	mux.HandleFunc("/v1/status/leader", s.handleStatusLeader)
+	s.Server = httptest.NewServer(s.intercept(mux))
+	return s
+}
+
+//agent的host，用于创建服务发现客户端
+func (s *ConsulServer) Host() string {
+	host, _, _ := net.SplitHostPort(s.Listener.Addr().String())
+	return host
+}
+
+//agent的端口，用于创建服务发现客户端
+func (s *ConsulServer) Port() int {
+	_, port, _ := net.SplitHostPort(s.Listener.Addr().String())
+	p, _ := strconv.Atoi(port)
+	return p
+}
+
+//使后续所有请求返回statusCode，为0时恢复正常，用于模拟consul不可用
+func (s *ConsulServer) FailRequests(statusCode int) {
+	s.mutex.Lock()
+	s.failStatus = statusCode
+	s.mutex.Unlock()
+	//唤醒阻塞查询，使其尽快观察到失败
+	s.bump()
+}
+
+//使后续请求等待d之后再处理，期间被取消的请求不会被处理，为0时恢复正常，用于模拟较慢的consul
+func (s *ConsulServer) DelayRequests(d time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.delay = d
+}
+
+//修改服务实例所有检查的状态
+func (s *ConsulServer) SetCheckStatus(instanceId, status string) {
+	s.mutex.Lock()
+	for _, check := range s.checks {
+		if check.ServiceID == instanceId {
+			check.Status = status
+		}
+	}
+	s.mutex.Unlock()
+	s.bump()
+}
+
+//查询已注册的服务实例
+func (s *ConsulServer) Registered(instanceId string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	_, ok := s.services[instanceId]
+	return ok
+}
+
+//直接删除服务实例及其检查，用于模拟agent重启后丢失注册
+func (s *ConsulServer) DropService(instanceId string) {
+	s.mutex.Lock()
+	s.removeService(instanceId)
+	s.mutex.Unlock()
+	s.bump()
+}
+
+//查询检查的当前状态，检查不存在时返回空字符串
+func (s *ConsulServer) CheckStatus(checkId string) string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if check, ok := s.checks[checkId]; ok {
+		return check.Status
+	}
+	return ""
+}
+
+//以prefix开头的路径收到的请求次数
+func (s *ConsulServer) Requests(prefix string) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	count := 0
+	for path, n := range s.requests {
+		if strings.HasPrefix(path, prefix) {
+			count += n
+		}
+	}
+	return count
+}
+
+//写入KV，相当于consul kv put
+func (s *ConsulServer) PutKV(key, value string) {
+	s.mutex.Lock()
+	s.putKV(key, []byte(value))
+	s.mutex.Unlock()
+	s.bump()
+}
+
+//删除KV，相当于consul kv delete
+func (s *ConsulServer) DeleteKV(key string) {
+	s.mutex.Lock()
+	delete(s.kv, key)
+	s.mutex.Unlock()
+	s.bump()
+}
+
+//KV的当前值
+func (s *ConsulServer) KV(key string) (string, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	entry, ok := s.kv[key]
+	if !ok {
+		return "", false
+	}
+	return string(entry.Value), true
+}
+
+//当前存在的session ID
+func (s *ConsulServer) Sessions() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	ids := make([]string, 0, len(s.sessions))
+	for id := range s.sessions {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+//销毁session并释放它持有的锁，用于模拟session过期
+func (s *ConsulServer) DestroySession(id string) {
+	s.mutex.Lock()
+	s.destroySession(id)
+	s.mutex.Unlock()
+	s.bump()
+}
+
+//持有KV锁的session，没有被锁定时返回空字符串
+func (s *ConsulServer) LockSession(key string) string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if entry, ok := s.kv[key]; ok {
+		return entry.Session
+	}
+	return ""
+}
+
+//当前的raft index
+func (s *ConsulServer) Index() uint64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.index
+}
+
+//设置stale查询返回的X-Consul-LastContact，模拟处理请求的server与leader失联
+func (s *ConsulServer) SetLastContact(d time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.lastContact = d
+}
+
+//最近一次服务实例查询使用的一致性模式：default、stale、consistent或cached
+func (s *ConsulServer) LastConsistency() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.lastConsistency
+}
+
+//记录请求并注入延迟和失败
+func (s *ConsulServer) intercept(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mutex.Lock()
+		s.requests[r.URL.Path]++
+		failStatus, delay := s.failStatus, s.delay
+		s.mutex.Unlock()
+		if delay > 0 {
+			//先读完请求体，之后连接断开时服务端才能取消请求
+			body, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				return
+			}
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+			select {
+			case <-time.After(delay):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		if failStatus != 0 {
+			http.Error(w, "injected failure", failStatus)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *ConsulServer) handleRegister(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var service fakeService
+	if err := json.NewDecoder(r.Body).Decode(&service); err != nil {
+		http.Error(w, "Request decode failed: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if service.Name == "" {
+		http.Error(w, "Missing service name", http.StatusBadRequest)
+		return
+	}
+	if service.ID == "" {
+		service.ID = service.Name
+	}
+	var checks []*fakeCheck
+	//与consul一致，忽略没有设置任何类型的空检查
+	for _, check := range append([]*fakeCheck{service.Check}, service.Checks...) {
+		if check != nil && (check.HTTP != "" || check.TCP != "" || check.GRPC != "" || check.TTL != "") {
+			checks = append(checks, check)
+		}
+	}
+	s.mutex.Lock()
+	s.removeService(service.ID)
+	s.services[service.ID] = &service
+	for i, check := range checks {
+		//与consul一致：单个检查的ID为service:<id>，多个检查时从1开始编号
+		checkId := check.CheckID
+		if checkId == "" {
+			checkId = "service:" + service.ID
+			if len(checks) > 1 {
+				checkId += ":" + strconv.Itoa(i+1)
+			}
+		}
+		status := check.Status
+		if status == "" {
+			status = "passing"
+			if check.TTL != "" {
+				status = "critical"
+			}
+		}
+		s.checks[checkId] = &checkState{
+			CheckID:   checkId,
+			Name:      check.Name,
+			Status:    status,
+			ServiceID: service.ID,
+		}
+	}
+	s.mutex.Unlock()
+	s.bump()
+}
+
+func (s *ConsulServer) handleDeregister(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	instanceId := strings.TrimPrefix(r.URL.Path, "/v1/agent/service/deregister/")
+	s.mutex.Lock()
+	_, ok := s.services[instanceId]
+	s.removeService(instanceId)
+	s.mutex.Unlock()
+	if !ok {
+		http.Error(w, "Unknown service ID "+strconv.Quote(instanceId), http.StatusNotFound)
+		return
+	}
+	s.bump()
+}
+
+func (s *ConsulServer) handleAgentService(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	instanceId := strings.TrimPrefix(r.URL.Path, "/v1/agent/service/")
+	s.mutex.Lock()
+	service, ok := s.services[instanceId]
+	var body map[string]interface{}
+	if ok {
+		body = map[string]interface{}{
+			"ID":      service.ID,
+			"Service": service.Name,
+			"Tags":    service.Tags,
+			"Address": service.Address,
+			"Port":    service.Port,
+			"Meta":    service.Meta,
+			"Weights": service.Weights,
+		}
+	}
+	s.mutex.Unlock()
+	if !ok {
+		http.Error(w, "unknown service ID: "+instanceId, http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(body)
+}
+
+//与consul一致，维护模式通过一个critical状态的检查实现
+func (s *ConsulServer) handleMaintenance(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	instanceId := strings.TrimPrefix(r.URL.Path, "/v1/agent/service/maintenance/")
+	query := r.URL.Query()
+	enable, err := strconv.ParseBool(query.Get("enable"))
+	if err != nil {
+		http.Error(w, "Missing value for enable", http.StatusBadRequest)
+		return
+	}
+	checkId := "_service_maintenance:" + instanceId
+	s.mutex.Lock()
+	_, ok := s.services[instanceId]
+	if ok && enable {
+		reason := query.Get("reason")
+		if reason == "" {
+			reason = "Maintenance mode is enabled for this service, but no reason was provided. This is a default message."
+		}
+		s.checks[checkId] = &checkState{
+			CheckID:   checkId,
+			Name:      "Service Maintenance Mode",
+			Status:    "critical",
+			Output:    reason,
+			ServiceID: instanceId,
+		}
+	} else if ok {
+		delete(s.checks, checkId)
+	}
+	s.mutex.Unlock()
+	if !ok {
+		http.Error(w, "No service registered with ID "+strconv.Quote(instanceId), http.StatusNotFound)
+		return
+	}
+	s.bump()
+}
+
+func (s *ConsulServer) handleCheckUpdate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	checkId := strings.TrimPrefix(r.URL.Path, "/v1/agent/check/update/")
+	var update struct {
+		Status string `json:"Status"`
+		Output string `json:"Output"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		http.Error(w, "Request decode failed: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.mutex.Lock()
+	check, ok := s.checks[checkId]
+	if ok {
+		check.Status = update.Status
+		check.Output = update.Output
+	}
+	s.mutex.Unlock()
+	if !ok {
+		http.Error(w, "Unknown check ID "+strconv.Quote(checkId), http.StatusNotFound)
+		return
+	}
+	s.bump()
+}
+
+//支持index和wait参数的阻塞查询，以及passing和tag过滤
+func (s *ConsulServer) handleHealthService(w http.ResponseWriter, r *http.Request) {
+	serviceName := strings.TrimPrefix(r.URL.Path, "/v1/health/service/")
+	query := r.URL.Query()
+	//只模拟了一个数据中心
+	if dc := query.Get("dc"); dc != "" && dc != s.Datacenter {
+		http.Error(w, "No path to datacenter", http.StatusInternalServerError)
+		return
+	}
+	//与consul一致，stale查询的server与leader失联超过max_stale时改由leader处理
+	consistency := "default"
+	for _, mode := range []string{"stale", "consistent", "cached"} {
+		if _, ok := query[mode]; ok {
+			consistency = mode
+		}
+	}
+	s.mutex.Lock()
+	s.lastConsistency = consistency
+	s.mutex.Unlock()
+	if !s.block(r) {
+		return
+	}
+
+	_, passingOnly := query["passing"]
+	tags := query["tag"]
+	s.mutex.Lock()
+	//阻塞查询返回时才读取，使等待期间的SetLastContact生效
+	lastContact := time.Duration(0)
+	if consistency == "stale" {
+		lastContact = s.lastContact
+		if maxStale, err := time.ParseDuration(query.Get("max_stale")); err == nil && lastContact > maxStale {
+			lastContact = 0
+		}
+	}
+	entries := make([]map[string]interface{}, 0)
+	for _, service := range s.services {
+		if service.Name != serviceName || !hasTags(service.Tags, tags) {
+			continue
+		}
+		var checks []*checkState
+		passing := true
+		for _, check := range s.checks {
+			if check.ServiceID == service.ID {
+				copied := *check
+				checks = append(checks, &copied)
+				passing = passing && check.Status == "passing"
+			}
+		}
+		if passingOnly && !passing {
+			continue
+		}
+		entries = append(entries, map[string]interface{}{
+			"Node": map[string]string{
+				"Node":       s.Node,
+				"Datacenter": s.Datacenter,
+				"Address":    "127.0.0.1",
+			},
+			"Service": map[string]interface{}{
+				"ID":      service.ID,
+				"Service": service.Name,
+				"Tags":    service.Tags,
+				"Address": service.Address,
+				"Port":    service.Port,
+				"Meta":    service.Meta,
+				"Weights": service.Weights,
+			},
+			"Checks": checks,
+		})
+	}
+	index := s.index
+	s.mutex.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(index, 10))
+	w.Header().Set("X-Consul-KnownLeader", "true")
+	w.Header().Set("X-Consul-LastContact", strconv.FormatInt(int64(lastContact/time.Millisecond), 10))
+	json.NewEncoder(w).Encode(entries)
+}
+
+//支持recurse的KV查询、写入和删除，查询支持index和wait参数的阻塞查询
+func (s *ConsulServer) handleKV(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+	_, recurse := r.URL.Query()["recurse"]
+	switch r.Method {
+	case http.MethodGet:
+		if !s.block(r) {
+			return
+		}
+		s.mutex.Lock()
+		entries := make([]*kvEntry, 0)
+		for k, entry := range s.kv {
+			if k == key || (recurse && strings.HasPrefix(k, key)) {
+				copied := *entry
+				entries = append(entries, &copied)
+			}
+		}
+		index := s.index
+		s.mutex.Unlock()
+		sort.Slice(entries, func(i, j int) bool {
+			return entries[i].Key < entries[j].Key
+		})
+		w.Header().Set("X-Consul-Index", strconv.FormatUint(index, 10))
+		w.Header().Set("X-Consul-KnownLeader", "true")
+		w.Header().Set("X-Consul-LastContact", "0")
+		if len(entries) == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(entries)
+	case http.MethodPut:
+		value, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		query := r.URL.Query()
+		flags, _ := strconv.ParseUint(query.Get("flags"), 10, 64)
+		s.mutex.Lock()
+		ok := true
+		switch {
+		case query.Get("acquire") != "":
+			ok, err = s.acquire(key, query.Get("acquire"), value, flags)
+		case query.Get("release") != "":
+			ok = s.release(key, query.Get("release"), value, flags)
+		default:
+			s.putKV(key, value).Flags = flags
+		}
+		s.mutex.Unlock()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if ok {
+			s.bump()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(strconv.FormatBool(ok)))
+	case http.MethodDelete:
+		s.mutex.Lock()
+		for k := range s.kv {
+			if k == key || (recurse && strings.HasPrefix(k, key)) {
+				delete(s.kv, k)
+			}
+		}
+		s.mutex.Unlock()
+		s.bump()
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte("true"))
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+//处理阻塞查询：index参数不小于当前index时等待数据变化或wait超时，请求被取消时返回false
+func (s *ConsulServer) block(r *http.Request) bool {
+	query := r.URL.Query()
+	index, err := strconv.ParseUint(query.Get("index"), 10, 64)
+	if err != nil || index == 0 {
+		return true
+	}
+	wait := 5 * time.Minute
+	if d, err := time.ParseDuration(query.Get("wait")); err == nil && d > 0 {
+		wait = d
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	for {
+		s.mutex.Lock()
+		current, changed := s.index, s.changed
+		s.mutex.Unlock()
+		if current > index {
+			return true
+		}
+		select {
+		case <-changed:
+		case <-timer.C:
+			return true
+		case <-r.Context().Done():
+			return false
+		}
+	}
+}
+
+//写入KV，index在bump之后才会增加，这里使用下一个index，需要持有锁
+func (s *ConsulServer) putKV(key string, value []byte) *kvEntry {
+	entry, ok := s.kv[key]
+	if !ok {
+		entry = &kvEntry{Key: key, CreateIndex: s.index + 1}
+		s.kv[key] = entry
+	}
+	entry.Value = value
+	entry.ModifyIndex = s.index + 1
+	return entry
+}
+
+//使用session获取KV锁，锁被其他session持有时返回false，需要持有锁
+func (s *ConsulServer) acquire(key, session string, value []byte, flags uint64) (bool, error) {
+	if _, ok := s.sessions[session]; !ok {
+		return false, fmt.Errorf("invalid session %q", session)
+	}
+	if entry, ok := s.kv[key]; ok && entry.Session != "" && entry.Session != session {
+		return false, nil
+	}
+	entry := s.putKV(key, value)
+	entry.Flags = flags
+	if entry.Session != session {
+		entry.Session = session
+		entry.LockIndex++
+	}
+	return true, nil
+}
+
+//释放session持有的KV锁，需要持有锁
+func (s *ConsulServer) release(key, session string, value []byte, flags uint64) bool {
+	entry, ok := s.kv[key]
+	if !ok || entry.Session != session {
+		return false
+	}
+	s.putKV(key, value).Flags = flags
+	entry.Session = ""
+	return true
+}
+
+func (s *ConsulServer) handleSessionCreate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var session fakeSession
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&session); err != nil {
+			http.Error(w, "Request decode failed: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	s.mutex.Lock()
+	s.sessionSeq++
+	session.ID = fmt.Sprintf("00000000-0000-0000-0000-%012d", s.sessionSeq)
+	s.sessions[session.ID] = &session
+	s.mutex.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"ID": session.ID})
+}
+
+func (s *ConsulServer) handleSessionRenew(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, "/v1/session/renew/")
+	s.mutex.Lock()
+	session, ok := s.sessions[id]
+	var copied fakeSession
+	if ok {
+		copied = *session
+	}
+	s.mutex.Unlock()
+	if !ok {
+		http.Error(w, "Session id '"+id+"' not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode([]fakeSession{copied})
+}
+
+func (s *ConsulServer) handleSessionDestroy(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	s.DestroySession(strings.TrimPrefix(r.URL.Path, "/v1/session/destroy/"))
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte("true"))
+}
+
+//删除session，按照release行为释放它持有的锁，需要持有锁
+func (s *ConsulServer) destroySession(id string) {
+	delete(s.sessions, id)
+	for _, entry := range s.kv {
+		if entry.Session == id {
+			entry.Session = ""
+			entry.ModifyIndex = s.index + 1
+		}
+	}
+}
+
+//单节点的集群，leader始终为自身
+func (s *ConsulServer) handleStatusLeader(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.Listener.Addr().String())
+}
+
+//删除服务实例及其检查，需要持有锁
+func (s *ConsulServer) removeService(instanceId string) {
+	delete(s.services, instanceId)
+	for id, check := range s.checks {
+		if check.ServiceID == instanceId {
+			delete(s.checks, id)
+		}
+	}
+}
+
+//数据发生变化，增加index并唤醒阻塞查询
+func (s *ConsulServer) bump() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.index++
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+func hasTags(serviceTags, tags []string) bool {
+	for _, tag := range tags {
+		found := false
+		for _, t := range serviceTags {
+			if t == tag {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
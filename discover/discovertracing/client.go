@@ -0,0 +1,106 @@
+package discovertracing
+
+import (
+	"context"
+	"errors"
+	"go.opencensus.io/trace"
+	"gomicro-discover/discover"
+)
+
+//为discover.Client的每次调用创建span的装饰器，ctx中有span时作为其子span，
+//服务发现的span记录服务名、返回的实例数以及结果是否来自缓存或过期数据
+
+//创建span的装饰器，通过NewClient创建
+type Client struct {
+	next discover.Client
+}
+
+//返回的客户端通过discover.Forward转发next实现的RegistrationChecker、MaintenanceSetter、Pinger、WatchLister接口
+func NewClient(next discover.Client) discover.Client {
+	return discover.Forward(&Client{next: next}, next)
+}
+
+func (c *Client) Register(ctx context.Context, registration *discover.Registration) error {
+	ctx, span := trace.StartSpan(ctx, "discover.Register", trace.WithSpanKind(trace.SpanKindClient))
+	defer span.End()
+	if registration != nil {
+		span.AddAttributes(
+			trace.StringAttribute("discover.service", registration.ServiceName),
+			trace.StringAttribute("discover.instance_id", registration.InstanceId),
+		)
+	}
+	err := c.next.Register(ctx, registration)
+	setStatus(span, err)
+	return err
+}
+
+func (c *Client) Deregister(ctx context.Context, instanceId string) error {
+	ctx, span := trace.StartSpan(ctx, "discover.Deregister", trace.WithSpanKind(trace.SpanKindClient))
+	defer span.End()
+	span.AddAttributes(trace.StringAttribute("discover.instance_id", instanceId))
+	err := c.next.Deregister(ctx, instanceId)
+	setStatus(span, err)
+	return err
+}
+
+//通过WithQueryMeta获取结果的元信息，调用方同样指定了WithQueryMeta时将元信息转写给调用方，查询失败时同样转写
+func (c *Client) DiscoverService(ctx context.Context, serviceName string, opts ...discover.QueryOption) ([]*discover.ServiceInstance, error) {
+	ctx, span := trace.StartSpan(ctx, "discover.DiscoverService", trace.WithSpanKind(trace.SpanKindClient))
+	defer span.End()
+	span.AddAttributes(trace.StringAttribute("discover.service", serviceName))
+	var options discover.QueryOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+	var meta discover.QueryMeta
+	instances, err := c.next.DiscoverService(ctx, serviceName, append(opts, discover.WithQueryMeta(&meta))...)
+	setStatus(span, err)
+	//查询失败时同样转写，外层的装饰器据此记录缓存命中情况
+	options.SetQueryMeta(meta)
+	if err != nil {
+		return nil, err
+	}
+	span.AddAttributes(
+		trace.Int64Attribute("discover.instances", int64(len(instances))),
+		trace.BoolAttribute("discover.cached", meta.Cached),
+		trace.BoolAttribute("discover.stale", meta.Stale),
+	)
+	return instances, nil
+}
+
+//只记录订阅的建立，之后的推送不在span中
+func (c *Client) Subscribe(ctx context.Context, serviceName string, opts ...discover.QueryOption) (<-chan discover.Event, error) {
+	ctx, span := trace.StartSpan(ctx, "discover.Subscribe", trace.WithSpanKind(trace.SpanKindClient))
+	defer span.End()
+	span.AddAttributes(trace.StringAttribute("discover.service", serviceName))
+	events, err := c.next.Subscribe(ctx, serviceName, opts...)
+	setStatus(span, err)
+	return events, err
+}
+
+func (c *Client) Close() error {
+	return c.next.Close()
+}
+
+//按错误类型设置span的状态
+func setStatus(span *trace.Span, err error) {
+	if err == nil {
+		return
+	}
+	code := int32(trace.StatusCodeUnknown)
+	switch {
+	case errors.Is(err, discover.ErrServiceNotFound):
+		code = trace.StatusCodeNotFound
+	case errors.Is(err, discover.ErrInvalidRegistration):
+		code = trace.StatusCodeInvalidArgument
+	case errors.Is(err, discover.ErrPermissionDenied):
+		code = trace.StatusCodePermissionDenied
+	case errors.Is(err, discover.ErrRegistryUnavailable):
+		code = trace.StatusCodeUnavailable
+	case errors.Is(err, discover.ErrClientClosed), errors.Is(err, context.Canceled):
+		code = trace.StatusCodeCancelled
+	case errors.Is(err, context.DeadlineExceeded):
+		code = trace.StatusCodeDeadlineExceeded
+	}
+	span.SetStatus(trace.Status{Code: code, Message: err.Error()})
+}
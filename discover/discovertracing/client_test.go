@@ -0,0 +1,33 @@
+package discovertracing_test
+
+import (
+	"context"
+	"errors"
+	"gomicro-discover/discover"
+	"gomicro-discover/discover/discovertest"
+	"gomicro-discover/discover/discovertracing"
+	"testing"
+)
+
+//查询失败但写入了元信息的客户端，与WatchSet从已有监控中没有找到实例时一致
+type failingClient struct {
+	*discovertest.Client
+}
+
+func (c failingClient) DiscoverService(ctx context.Context, serviceName string, opts ...discover.QueryOption) ([]*discover.ServiceInstance, error) {
+	discover.NewQueryOptions(opts...).SetQueryMeta(discover.QueryMeta{Cached: true, KnownLeader: true})
+	return nil, discover.ErrServiceNotFound
+}
+
+//查询失败时同样将元信息转写给调用方，外层的指标装饰器依赖它记录缓存命中
+func TestDiscoverServiceForwardsMetaOnError(t *testing.T) {
+	client := discovertracing.NewClient(failingClient{discovertest.NewClient()})
+	var meta discover.QueryMeta
+	_, err := client.DiscoverService(context.Background(), "string", discover.WithQueryMeta(&meta))
+	if !errors.Is(err, discover.ErrServiceNotFound) {
+		t.Fatalf("DiscoverService() = %v, want ErrServiceNotFound", err)
+	}
+	if !meta.Cached || !meta.KnownLeader {
+		t.Fatalf("meta = %+v, want the meta of the failed lookup", meta)
+	}
+}
@@ -0,0 +1,65 @@
+package discover
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+//服务发现客户端返回的错误，调用方可以通过errors.Is进行判断
+
+var (
+	//consul无法访问或返回了服务端错误
+	ErrRegistryUnavailable = errors.New("registry unavailable")
+	//没有找到可用的服务实例
+	ErrServiceNotFound = errors.New("service not found")
+	//服务注册信息不合法
+	ErrInvalidRegistration = errors.New("invalid registration")
+	//ACL token缺失或权限不足
+	ErrPermissionDenied = errors.New("permission denied")
+	//客户端已关闭
+	ErrClientClosed = errors.New("discovery client closed")
+	//客户端不支持维护模式
+	ErrMaintenanceUnsupported = errors.New("maintenance mode not supported")
+)
+
+//将consul调用返回的错误转换为对应的类型错误
+func WrapConsulError(err error) error {
+	if err == nil {
+		return nil
+	}
+	//context取消或超时的错误直接返回给调用方
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return err
+	}
+	//consul对于不合法的注册请求返回400
+	if strings.Contains(err.Error(), "Unexpected response code: 400") {
+		return fmt.Errorf("%w: %v", ErrInvalidRegistration, err)
+	}
+	//ACL拒绝访问时返回403
+	if strings.Contains(err.Error(), "Unexpected response code: 403") {
+		return fmt.Errorf("%w: %v", ErrPermissionDenied, err)
+	}
+	//注销不存在的实例时返回404
+	if strings.Contains(err.Error(), "Unexpected response code: 404") {
+		return fmt.Errorf("%w: %v", ErrServiceNotFound, err)
+	}
+	return fmt.Errorf("%w: %v", ErrRegistryUnavailable, err)
+}
+
+//根据consul返回的http状态码生成对应的类型错误
+func statusError(statusCode int) error {
+	switch {
+	case statusCode == 200:
+		return nil
+	case statusCode == 400:
+		return fmt.Errorf("%w: consul returned status %d", ErrInvalidRegistration, statusCode)
+	case statusCode == 403:
+		return fmt.Errorf("%w: consul returned status %d", ErrPermissionDenied, statusCode)
+	case statusCode == 404:
+		return fmt.Errorf("%w: consul returned status %d", ErrServiceNotFound, statusCode)
+	default:
+		return fmt.Errorf("%w: consul returned status %d", ErrRegistryUnavailable, statusCode)
+	}
+}
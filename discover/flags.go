@@ -0,0 +1,71 @@
+package discover
+
+import (
+	"flag"
+	"time"
+)
+
+//连接consul和服务发现客户端的命令行参数，网关和string-service共用
+type ClientFlags struct {
+	//consul 地址
+	Host string
+	Port int
+
+	//consul ACL token，均未设置时使用环境变量CONSUL_HTTP_TOKEN
+	token     string
+	tokenFile string
+	//consul https配置
+	tls       bool
+	tlsConfig TLSConfig
+	//服务发现的本地快照，consul不可达时返回快照或之前获取的实例，超过snapshotMaxAge后不再返回
+	snapshot       string
+	snapshotMaxAge time.Duration
+	//服务发现读取的默认一致性模式，stale模式下server与leader失联超过consulMaxStale时改由leader处理
+	consistency    string
+	consulMaxStale time.Duration
+}
+
+//在fs中注册consul.*和discovery.*参数，需要在fs.Parse之前调用
+func RegisterClientFlags(fs *flag.FlagSet) *ClientFlags {
+	f := &ClientFlags{}
+	fs.StringVar(&f.Host, "consul.host", "127.0.0.1", "consul host")
+	fs.IntVar(&f.Port, "consul.port", 8500, "consul port")
+
+	fs.StringVar(&f.token, "consul.token", "", "consul acl token")
+	fs.StringVar(&f.tokenFile, "consul.token-file", "", "file containing the consul acl token")
+	fs.BoolVar(&f.tls, "consul.tls", false, "use https to talk to consul")
+	fs.StringVar(&f.tlsConfig.CAFile, "consul.ca-file", "", "ca bundle used to verify the consul certificate")
+	fs.StringVar(&f.tlsConfig.CertFile, "consul.cert-file", "", "client certificate for consul")
+	fs.StringVar(&f.tlsConfig.KeyFile, "consul.key-file", "", "client private key for consul")
+	fs.StringVar(&f.tlsConfig.ServerName, "consul.tls-server-name", "", "server name used to verify the consul certificate")
+	fs.BoolVar(&f.tlsConfig.InsecureSkipVerify, "consul.tls-skip-verify", false, "skip verifying the consul certificate")
+
+	fs.StringVar(&f.snapshot, "discovery.snapshot", "", "file persisting the last known instances of discovered services, empty to disable")
+	fs.DurationVar(&f.snapshotMaxAge, "discovery.snapshot-max-age", time.Hour, "maximum age of cached instances served while consul is unreachable, 0 for no limit")
+	fs.StringVar(&f.consistency, "discovery.consistency", "default", "default consistency mode of discovery reads: default, stale, consistent or cached")
+	fs.DurationVar(&f.consulMaxStale, "discovery.consul-max-stale", 0, "in stale mode, fall back to the leader when the serving consul server lags more than this, 0 for no limit")
+	return f
+}
+
+//根据解析后的参数创建客户端的配置项，一致性模式无效时返回错误
+func (f *ClientFlags) Options() ([]ClientOption, error) {
+	var opts []ClientOption
+	if f.token != "" {
+		opts = append(opts, WithToken(f.token))
+	}
+	if f.tokenFile != "" {
+		opts = append(opts, WithTokenFile(f.tokenFile))
+	}
+	if f.snapshot != "" {
+		opts = append(opts, WithSnapshot(f.snapshot, f.snapshotMaxAge))
+	}
+	consistency, err := ParseConsistencyMode(f.consistency)
+	if err != nil {
+		return nil, err
+	}
+	opts = append(opts, WithDefaultConsistency(consistency, f.consulMaxStale))
+	if f.tls {
+		opts = append(opts, WithTLS(f.tlsConfig))
+	}
+	return opts, nil
+}
@@ -0,0 +1,30 @@
+package discover_test
+
+import (
+	"flag"
+	"gomicro-discover/discover"
+	"testing"
+)
+
+func TestClientFlags(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	flags := discover.RegisterClientFlags(fs)
+	if err := fs.Parse([]string{"-consul.host", "consul.local", "-consul.port", "8501", "-consul.token", "secret", "-consul.tls", "-discovery.consistency", "stale"}); err != nil {
+		t.Fatal(err)
+	}
+	if flags.Host != "consul.local" || flags.Port != 8501 {
+		t.Fatalf("address = %s:%d, want consul.local:8501", flags.Host, flags.Port)
+	}
+	//token、一致性模式和https各一项
+	opts, err := flags.Options()
+	if err != nil || len(opts) != 3 {
+		t.Fatalf("Options() = %d options, %v, want 3 options", len(opts), err)
+	}
+
+	if err := fs.Parse([]string{"-discovery.consistency", "eventual"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := flags.Options(); err == nil {
+		t.Fatal("Options() with an unknown consistency mode succeeded")
+	}
+}
@@ -0,0 +1,74 @@
+package discover
+
+import "context"
+
+//装饰器（如discovermetrics、discovertracing）转发可选接口的辅助函数
+
+//包装装饰器decorator，转发被装饰的客户端next实现的可选接口。
+//RegistrationChecker、Pinger、WatchLister只在next实现时才被实现，使调用方通过类型断言得到的能力与next一致，
+//避免next不支持时Registrar不再重新注册、就绪检查总是认为consul可达；
+//MaintenanceSetter总是被实现，next不支持时返回ErrMaintenanceUnsupported，与Registrar的处理一致
+func Forward(decorator, next Client) Client {
+	base := forwarder{Client: decorator, next: next}
+	checker, isChecker := next.(RegistrationChecker)
+	pinger, isPinger := next.(Pinger)
+	lister, isLister := next.(WatchLister)
+	switch {
+	case isChecker && isPinger && isLister:
+		return struct {
+			forwarder
+			RegistrationChecker
+			Pinger
+			WatchLister
+		}{base, checker, pinger, lister}
+	case isChecker && isPinger:
+		return struct {
+			forwarder
+			RegistrationChecker
+			Pinger
+		}{base, checker, pinger}
+	case isChecker && isLister:
+		return struct {
+			forwarder
+			RegistrationChecker
+			WatchLister
+		}{base, checker, lister}
+	case isPinger && isLister:
+		return struct {
+			forwarder
+			Pinger
+			WatchLister
+		}{base, pinger, lister}
+	case isChecker:
+		return struct {
+			forwarder
+			RegistrationChecker
+		}{base, checker}
+	case isPinger:
+		return struct {
+			forwarder
+			Pinger
+		}{base, pinger}
+	case isLister:
+		return struct {
+			forwarder
+			WatchLister
+		}{base, lister}
+	default:
+		return base
+	}
+}
+
+//Client的调用由装饰器处理，维护模式转发给被装饰的客户端
+type forwarder struct {
+	Client
+	next Client
+}
+
+func (f forwarder) SetMaintenance(ctx context.Context, instanceId string, enable bool, reason string) error {
+	setter, ok := f.next.(MaintenanceSetter)
+	if !ok {
+		return ErrMaintenanceUnsupported
+	}
+	return setter.SetMaintenance(ctx, instanceId, enable, reason)
+}
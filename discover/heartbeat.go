@@ -0,0 +1,153 @@
+package discover
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+//TTL健康检查模式下，由服务实例主动向consul上报心跳
+
+//连续失败多少次后将检查标记为critical，之前标记为warning
+const heartbeatCriticalThreshold = 3
+
+//更新TTL检查状态的函数，由具体的客户端实现
+type TTLUpdater func(ctx context.Context, checkId, status, output string) error
+
+type heartbeat struct {
+	checkId     string
+	interval    time.Duration
+	healthCheck func() bool
+	update      TTLUpdater
+	stopOnce    sync.Once
+	stop        chan struct{}
+	done        chan struct{}
+}
+
+//检查的默认ID，consul为注册时内嵌的单个检查生成的ID为service:<instanceId>
+func defaultCheckId(instanceId string) string {
+	return "service:" + instanceId
+}
+
+func newHeartbeat(checkId string, ttl time.Duration, healthCheck func() bool, update TTLUpdater) *heartbeat {
+	//每个TTL周期内至少上报三次，避免单次请求失败导致检查超时
+	interval := ttl / 3
+	if interval <= 0 {
+		interval = time.Second
+	}
+	return &heartbeat{
+		checkId:     checkId,
+		interval:    interval,
+		healthCheck: healthCheck,
+		update:      update,
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+}
+
+//启动心跳协程，立即上报一次使检查尽快变为passing
+func (h *heartbeat) start() {
+	go func() {
+		defer close(h.done)
+		ticker := time.NewTicker(h.interval)
+		defer ticker.Stop()
+		failures := 0
+		for {
+			failures = h.beat(failures)
+			select {
+			case <-ticker.C:
+			case <-h.stop:
+				return
+			}
+		}
+	}()
+}
+
+//上报一次心跳，返回服务自身健康检查的连续失败次数
+func (h *heartbeat) beat(failures int) int {
+	status, output := HealthPassing, "heartbeat ok"
+	if h.healthCheck != nil && !h.healthCheck() {
+		failures++
+		status, output = HealthWarning, "service health check failed"
+		if failures >= heartbeatCriticalThreshold {
+			status = HealthCritical
+		}
+	} else {
+		failures = 0
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), h.interval)
+	defer cancel()
+	if err := h.update(ctx, h.checkId, status, output); err != nil {
+		log.Println("Update TTL Check Error:", err)
+	}
+	return failures
+}
+
+//停止心跳并等待协程退出
+func (h *heartbeat) close() {
+	h.stopOnce.Do(func() {
+		close(h.stop)
+	})
+	<-h.done
+}
+
+//按实例ID管理心跳，注销实例时停止对应的心跳
+type Heartbeats struct {
+	mutex sync.Mutex
+	beats map[string][]*heartbeat
+}
+
+//为服务实例的每个TTL检查启动心跳，没有TTL检查时只停止旧的心跳
+func (hs *Heartbeats) Register(instanceId string, checks []*CheckDefinition, healthCheck func() bool, update TTLUpdater) {
+	var beats []*heartbeat
+	for _, check := range checks {
+		if check.TTL > 0 {
+			beats = append(beats, newHeartbeat(check.ID, check.TTL, healthCheck, update))
+		}
+	}
+	hs.start(instanceId, beats)
+}
+
+func (hs *Heartbeats) start(instanceId string, beats []*heartbeat) {
+	hs.mutex.Lock()
+	defer hs.mutex.Unlock()
+	if hs.beats == nil {
+		hs.beats = make(map[string][]*heartbeat)
+	}
+	//重复注册时替换旧的心跳
+	for _, old := range hs.beats[instanceId] {
+		old.close()
+	}
+	delete(hs.beats, instanceId)
+	if len(beats) == 0 {
+		return
+	}
+	hs.beats[instanceId] = beats
+	for _, h := range beats {
+		h.start()
+	}
+}
+
+func (hs *Heartbeats) Stop(instanceId string) {
+	hs.mutex.Lock()
+	beats := hs.beats[instanceId]
+	delete(hs.beats, instanceId)
+	hs.mutex.Unlock()
+	for _, h := range beats {
+		h.close()
+	}
+}
+
+//停止全部心跳
+func (hs *Heartbeats) StopAll() {
+	hs.mutex.Lock()
+	all := hs.beats
+	hs.beats = nil
+	hs.mutex.Unlock()
+	for _, beats := range all {
+		for _, h := range beats {
+			h.close()
+		}
+	}
+}
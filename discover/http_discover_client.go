@@ -2,10 +2,15 @@ package discover
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
-	"log"
+	"errors"
+	"fmt"
 	"net/http"
+	"net/url"
 	"strconv"
+	"sync"
+	"time"
 )
 
 //直接使用http的方式与consul进行交互
@@ -21,16 +26,26 @@ type InstanceInfo struct {
 	Meta              map[string]string          `json:"Meta"`              //元数据
 	EnableTagOverride bool                       `json:"EnableTagOverride"` //是否允许标签覆盖
 	Check             `json:"Check,omitempty"`   //健康检查相关配置
+	Checks            []Check                    `json:"Checks,omitempty"` //多个健康检查，与Check同时设置时都会注册
 	Weights           `json:"Weights,omitempty"` //权重
 }
 
 //健康检查
 type Check struct {
-	DeregisterCriticalServiceAfter string   `json:"DeregisterCriticalServiceAfter"` //多久之后注销服务
-	Args                           []string `json:"Args,omitempty"`                 //请求参数
-	HTTP                           string   `json:"HTTP"`                           //健康检查的地址
-	Interval                       string   `json:"Interval,omitempty"`             //consul主动检查间隔
-	TTL                            string   `json:"TTL,omitempty"`                  //服务实例主动维持心跳间隔，与interval只使用其中一种
+	CheckID                        string              `json:"CheckID,omitempty"`              //检查ID
+	Name                           string              `json:"Name,omitempty"`                 //检查名
+	DeregisterCriticalServiceAfter string              `json:"DeregisterCriticalServiceAfter"` //多久之后注销服务
+	Args                           []string            `json:"Args,omitempty"`                 //请求参数
+	HTTP                           string              `json:"HTTP"`                           //健康检查的地址
+	Method                         string              `json:"Method,omitempty"`               //HTTP检查的请求方法
+	Header                         map[string][]string `json:"Header,omitempty"`               //HTTP检查的请求头
+	TLSSkipVerify                  bool                `json:"TLSSkipVerify,omitempty"`        //HTTPS检查时不校验证书
+	TCP                            string              `json:"TCP,omitempty"`                  //TCP检查的地址
+	GRPC                           string              `json:"GRPC,omitempty"`                 //gRPC健康检查的地址
+	GRPCUseTLS                     bool                `json:"GRPCUseTLS,omitempty"`           //gRPC检查是否使用TLS
+	Interval                       string              `json:"Interval,omitempty"`             //consul主动检查间隔
+	Timeout                        string              `json:"Timeout,omitempty"`              //单次检查的超时时间
+	TTL                            string              `json:"TTL,omitempty"`                  //服务实例主动维持心跳间隔，与interval只使用其中一种
 }
 
 //权重
@@ -39,99 +54,349 @@ type Weights struct {
 	Warning int `json:"Warning"`
 }
 
+///v1/health/service接口返回的服务实例条目
+type healthEntry struct {
+	Node struct {
+		Node       string `json:"Node"`
+		Datacenter string `json:"Datacenter"`
+		Address    string `json:"Address"`
+	} `json:"Node"`
+	Service InstanceInfo  `json:"Service"`
+	Checks  []checkStatus `json:"Checks"`
+}
+
+//转换为ServiceInstance
+func (e *healthEntry) instance() *ServiceInstance {
+	instance := &ServiceInstance{
+		ID:          e.Service.ID,
+		ServiceName: e.Service.Service,
+		Address:     e.Service.Address,
+		Port:        e.Service.Port,
+		Tags:        e.Service.Tags,
+		Meta:        e.Service.Meta,
+		Weights:     e.Service.Weights,
+		Status:      aggregatedStatus(e.Checks),
+		Node:        e.Node.Node,
+		Datacenter:  e.Node.Datacenter,
+	}
+	//服务没有单独设置地址时使用节点地址
+	if instance.Address == "" {
+		instance.Address = e.Node.Address
+	}
+	return instance
+}
+
+//阻塞查询默认的最长等待时间，与consul的默认值一致
+const defaultWaitTime = 5 * time.Minute
+
 type HTTPDiscoverClient struct {
-	Host string //consul的host
-	Port int    //consul的port
+	Host     string        //consul的host
+	Port     int           //consul的port
+	WaitTime time.Duration //阻塞查询的最长等待时间，为0时使用默认值
+	Scheme   string        //访问consul的协议，为空时使用http
+	Token    string        //ACL token
+	//发送请求使用的http.Client，为空时使用http.DefaultClient
+	HTTPClient *http.Client
+	//没有订阅者的阻塞查询空闲多久之后停止，为0时使用默认值
+	IdleTimeout time.Duration
+	//本地快照文件，为空时不使用快照
+	SnapshotPath string
+	//consul不可达时返回过期数据的最长时间，为0时不限制
+	MaxStale time.Duration
+	//查询没有指定一致性模式时使用的模式，为空时使用consul的默认模式
+	Consistency Consistency
+	//TTL模式下的心跳
+	heartbeats Heartbeats
+	//按服务名管理的阻塞查询及缓存
+	watchOnce sync.Once
+	watches   *WatchSet
 }
 
-func (H HTTPDiscoverClient) Register(serviceName, instanceId, healthCheckUrl string, instanceHost string, instancePort int, meta map[string]string, logger *log.Logger) bool {
+func (H *HTTPDiscoverClient) Register(ctx context.Context, registration *Registration) error {
+	if err := registration.Validate(); err != nil {
+		return err
+	}
+	checks := registration.EffectiveChecks()
 	//封装服务实例的元数据
 	instanceInfo := &InstanceInfo{
-		ID:                instanceId,
-		Name:              serviceName,
-		Address:           instanceHost,
-		Port:              instancePort,
-		Meta:              meta,
+		ID:                registration.InstanceId,
+		Name:              registration.ServiceName,
+		Address:           registration.InstanceHost,
+		Port:              registration.InstancePort,
+		Meta:              registration.Meta,
+		Tags:              registration.Tags,
 		EnableTagOverride: false,
-		Check: Check{
-			DeregisterCriticalServiceAfter: "30s",
-			HTTP:                           "http://" + instanceHost + ":" + strconv.Itoa(instancePort) + healthCheckUrl,
-			Interval:                       "15s",
-		},
-		Weights: Weights{
-			Passing: 10,
-			Warning: 1,
-		},
+		Weights:           registration.EffectiveWeights(),
+	}
+	//所有检查都放在Checks中，Check保持为空
+	for _, check := range checks {
+		instanceInfo.Checks = append(instanceInfo.Checks, Check{
+			CheckID:                        check.ID,
+			Name:                           check.Name,
+			DeregisterCriticalServiceAfter: durationString(check.DeregisterCriticalServiceAfter),
+			HTTP:                           check.HTTP,
+			Method:                         check.Method,
+			Header:                         check.Header,
+			TLSSkipVerify:                  check.TLSSkipVerify,
+			TCP:                            check.TCP,
+			GRPC:                           check.GRPC,
+			GRPCUseTLS:                     check.GRPCUseTLS,
+			Interval:                       durationString(check.Interval),
+			Timeout:                        durationString(check.Timeout),
+			TTL:                            durationString(check.TTL),
+		})
 	}
 	byteData, _ := json.Marshal(instanceInfo)
 
 	//使用http向consul发送服务注册请求
-	req, err := http.NewRequest("PUT", "http://"+H.Host+":"+strconv.Itoa(H.Port)+"/v1/agent/service/register", bytes.NewReader(byteData))
-	if err == nil {
-		req.Header.Set("Content-Type", "application/json;charset=utf-8")
-		client := http.Client{}
-		resp, err := client.Do(req)
-		//检查注册的结果
-		if err != nil {
-			log.Println("Register Service Error")
-		} else {
-			resp.Body.Close()
-			if resp.StatusCode == 200 {
-				log.Println("Register Service Success")
-			} else {
-				log.Println("Register Service Error")
-			}
-		}
+	req, err := http.NewRequestWithContext(ctx, "PUT", H.address()+"/v1/agent/service/register", bytes.NewReader(byteData))
+	if err != nil {
+		return err
 	}
-	return false
+	req.Header.Set("Content-Type", "application/json;charset=utf-8")
+	resp, err := H.do(req)
+	//检查注册的结果
+	if err != nil {
+		return WrapConsulError(err)
+	}
+	resp.Body.Close()
+	if err := statusError(resp.StatusCode); err != nil {
+		return err
+	}
+	//为TTL检查启动心跳
+	H.heartbeats.Register(registration.InstanceId, checks, registration.HealthCheck, H.updateTTL)
+	return nil
 }
 
-func (H HTTPDiscoverClient) Deregister(instanceId string, logger *log.Logger) bool {
+//更新TTL检查的状态
+func (H *HTTPDiscoverClient) updateTTL(ctx context.Context, checkId, status, output string) error {
+	byteData, _ := json.Marshal(map[string]string{
+		"Status": status,
+		"Output": output,
+	})
+	req, err := http.NewRequestWithContext(ctx, "PUT", H.address()+"/v1/agent/check/update/"+checkId, bytes.NewReader(byteData))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json;charset=utf-8")
+	resp, err := H.do(req)
+	if err != nil {
+		return WrapConsulError(err)
+	}
+	resp.Body.Close()
+	return statusError(resp.StatusCode)
+}
+
+func (H *HTTPDiscoverClient) Deregister(ctx context.Context, instanceId string) error {
+	//停止心跳
+	H.heartbeats.Stop(instanceId)
 	//发送注销请求
-	req, err := http.NewRequest("PUT", "http://"+H.Host+":"+strconv.Itoa(H.Port)+"/v1/agent/service/deregister/"+instanceId, nil)
-	client := http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		log.Println("Deregister Service Error")
-	} else {
-		resp.Body.Close()
-		if resp.StatusCode == 200 {
-			log.Println("Deregister Service Success")
-			return true
-		} else {
-			log.Println("Deregister Service Error")
-		}
+	req, err := http.NewRequestWithContext(ctx, "PUT", H.address()+"/v1/agent/service/deregister/"+instanceId, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := H.do(req)
+	if err != nil {
+		return WrapConsulError(err)
 	}
-	return false
+	resp.Body.Close()
+	return statusError(resp.StatusCode)
 }
 
-func (H HTTPDiscoverClient) DiscoverService(serviceName string, logger *log.Logger) []interface{} {
-	//从consul获取服务实例列表
-	req, err := http.NewRequest("GET", "http://"+H.Host+":"+strconv.Itoa(H.Port)+"/v1/health/service/"+serviceName, nil)
-	client := http.Client{}
-	resp, err := client.Do(req)
+//直接查询本地agent的/v1/agent/service接口，判断服务实例是否仍注册在agent上，不经过缓存
+func (H *HTTPDiscoverClient) Registered(ctx context.Context, instanceId string) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", H.address()+"/v1/agent/service/"+instanceId, nil)
 	if err != nil {
-		log.Println("Discover Service Error")
-	} else if resp.StatusCode == 200 {
-		var serviceList []struct {
-			Service InstanceInfo `json:"Service"`
-		}
-		err = json.NewDecoder(resp.Body).Decode(serviceList)
-		resp.Body.Close()
-		if err == nil {
-			instances := make([]interface{}, len(serviceList))
-			for i := 0; i < len(instances); i++ {
-				instances[i] = serviceList[i].Service
-			}
-			return instances
-		}
+		return false, err
+	}
+	resp, err := H.do(req)
+	if err != nil {
+		return false, WrapConsulError(err)
+	}
+	resp.Body.Close()
+	if err = statusError(resp.StatusCode); errors.Is(err, ErrServiceNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (H *HTTPDiscoverClient) SetMaintenance(ctx context.Context, instanceId string, enable bool, reason string) error {
+	params := url.Values{}
+	params.Set("enable", strconv.FormatBool(enable))
+	if reason != "" {
+		params.Set("reason", reason)
+	}
+	req, err := http.NewRequestWithContext(ctx, "PUT", H.address()+"/v1/agent/service/maintenance/"+instanceId+"?"+params.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := H.do(req)
+	if err != nil {
+		return WrapConsulError(err)
+	}
+	resp.Body.Close()
+	return statusError(resp.StatusCode)
+}
+
+//查询集群的leader，没有leader时consul无法处理写请求，视为不可用
+func (H *HTTPDiscoverClient) Ping(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", H.address()+"/v1/status/leader", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := H.do(req)
+	if err != nil {
+		return WrapConsulError(err)
 	}
+	defer resp.Body.Close()
+	if err := statusError(resp.StatusCode); err != nil {
+		return err
+	}
+	var leader string
+	if err := json.NewDecoder(resp.Body).Decode(&leader); err != nil {
+		return fmt.Errorf("%w: %v", ErrRegistryUnavailable, err)
+	}
+	if leader == "" {
+		return fmt.Errorf("%w: no cluster leader", ErrRegistryUnavailable)
+	}
+	return nil
+}
+
+//从本地缓存中查询服务实例，缓存由后台的阻塞查询持续更新
+func (H *HTTPDiscoverClient) DiscoverService(ctx context.Context, serviceName string, opts ...QueryOption) ([]*ServiceInstance, error) {
+	return H.watchSet().Discover(ctx, serviceName, opts...)
+}
+
+//订阅服务实例的变化，与DiscoverService共用同一个阻塞查询
+func (H *HTTPDiscoverClient) Subscribe(ctx context.Context, serviceName string, opts ...QueryOption) (<-chan Event, error) {
+	return H.watchSet().Subscribe(ctx, serviceName, opts...)
+}
+
+//列出正在运行的阻塞查询
+func (H *HTTPDiscoverClient) Watches() []WatchInfo {
+	return H.watchSet().List()
+}
+
+//停止全部阻塞查询和心跳
+func (H *HTTPDiscoverClient) Close() error {
+	H.watchSet().Close()
+	H.heartbeats.StopAll()
 	return nil
 }
 
-func NewHTTPDiscoverClient(consulHost string, consulPort int) (DiscoveryClient, error) {
+//第一次使用时创建监控集合，使直接构造的HTTPDiscoverClient也可以使用
+func (H *HTTPDiscoverClient) watchSet() *WatchSet {
+	H.watchOnce.Do(func() {
+		H.watches = NewWatchSet(H.fetch, &ClientConfig{
+			IdleTimeout:  H.IdleTimeout,
+			SnapshotPath: H.SnapshotPath,
+			MaxStale:     H.MaxStale,
+			Consistency:  H.Consistency,
+		})
+	})
+	return H.watches
+}
+
+//查询服务的可用实例，index大于0时为阻塞查询，直到数据变化或等待超时才返回
+func (H *HTTPDiscoverClient) fetch(ctx context.Context, key WatchKey, index uint64) ([]*ServiceInstance, ResponseMeta, error) {
+	params := url.Values{}
+	key.Consistency.setParams(params)
+	if key.Datacenter != "" {
+		params.Set("dc", key.Datacenter)
+	}
+	if index > 0 {
+		params.Set("index", strconv.FormatUint(index, 10))
+		//按秒取整会使1s以下的等待时间变为0s，使用毫秒
+		params.Set("wait", fmt.Sprintf("%dms", H.waitTime()/time.Millisecond))
+	}
+	reqUrl := H.address() + "/v1/health/service/" + url.PathEscape(key.ServiceName)
+	if len(params) > 0 {
+		reqUrl += "?" + params.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", reqUrl, nil)
+	if err != nil {
+		return nil, ResponseMeta{}, err
+	}
+	resp, err := H.do(req)
+	if err != nil {
+		return nil, ResponseMeta{}, WrapConsulError(err)
+	}
+	defer resp.Body.Close()
+	if err := statusError(resp.StatusCode); err != nil {
+		return nil, ResponseMeta{}, err
+	}
+	var meta ResponseMeta
+	meta.Index, _ = strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	lastContact, _ := strconv.ParseUint(resp.Header.Get("X-Consul-LastContact"), 10, 64)
+	meta.LastContact = time.Duration(lastContact) * time.Millisecond
+	meta.KnownLeader = resp.Header.Get("X-Consul-KnownLeader") == "true"
+	var serviceList []healthEntry
+	err = json.NewDecoder(resp.Body).Decode(&serviceList)
+	if err != nil {
+		return nil, ResponseMeta{}, fmt.Errorf("%w: decode health response: %v", ErrRegistryUnavailable, err)
+	}
+	instances := make([]*ServiceInstance, len(serviceList))
+	for i := 0; i < len(instances); i++ {
+		instances[i] = serviceList[i].instance()
+		if instances[i].Datacenter == "" {
+			instances[i].Datacenter = key.Datacenter
+		}
+	}
+	return HealthyInstances(instances), meta, nil
+}
+
+//阻塞查询的等待时间
+func (H *HTTPDiscoverClient) waitTime() time.Duration {
+	if H.WaitTime > 0 {
+		return H.WaitTime
+	}
+	return defaultWaitTime
+}
+
+//consul的访问地址
+func (H *HTTPDiscoverClient) address() string {
+	scheme := H.Scheme
+	if scheme == "" {
+		scheme = "http"
+	}
+	return scheme + "://" + H.Host + ":" + strconv.Itoa(H.Port)
+}
+
+//发送请求，设置了ACL token时通过X-Consul-Token请求头传递
+func (H *HTTPDiscoverClient) do(req *http.Request) (*http.Response, error) {
+	if H.Token != "" {
+		req.Header.Set("X-Consul-Token", H.Token)
+	}
+	if H.HTTPClient != nil {
+		return H.HTTPClient.Do(req)
+	}
+	return http.DefaultClient.Do(req)
+}
+
+func NewHTTPDiscoverClient(consulHost string, consulPort int, opts ...ClientOption) (Client, error) {
+	config, err := NewClientConfig(opts...)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig, err := config.TLSClientConfig(consulHost)
+	if err != nil {
+		return nil, err
+	}
+	httpClient := &http.Client{}
+	if tlsConfig != nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = tlsConfig
+		httpClient.Transport = transport
+	}
 	return &HTTPDiscoverClient{
-		Host: consulHost,
-		Port: consulPort,
+		Host:         consulHost,
+		Port:         consulPort,
+		Scheme:       config.Scheme(),
+		Token:        config.Token,
+		HTTPClient:   httpClient,
+		IdleTimeout:  config.IdleTimeout,
+		SnapshotPath: config.SnapshotPath,
+		MaxStale:     config.MaxStale,
+		Consistency:  config.Consistency,
 	}, nil
 }
@@ -0,0 +1,81 @@
+package discover
+
+import "strings"
+
+//服务实例的健康状态
+const (
+	HealthPassing     = "passing"
+	HealthWarning     = "warning"
+	HealthCritical    = "critical"
+	HealthMaintenance = "maintenance"
+)
+
+//服务实例，所有服务发现客户端返回的都是该结构，调用方不需要关心具体使用的是哪种客户端
+type ServiceInstance struct {
+	ID          string            `json:"id"`             //服务实例ID
+	ServiceName string            `json:"service_name"`   //服务名
+	Address     string            `json:"address"`        //服务实例的host
+	Port        int               `json:"port"`           //服务实例端口
+	Tags        []string          `json:"tags,omitempty"` //标签
+	Meta        map[string]string `json:"meta,omitempty"` //元数据
+	Weights     Weights           `json:"weights"`        //权重
+	Status      string            `json:"status"`         //聚合后的健康状态
+	Node        string            `json:"node"`           //所在的consul节点
+	Datacenter  string            `json:"datacenter"`     //所在的数据中心
+}
+
+//passing和warning状态的实例都认为是可用的，与consul dns的默认行为一致
+func (s *ServiceInstance) Healthy() bool {
+	return s.Status == HealthPassing || s.Status == HealthWarning
+}
+
+//过滤出可用的服务实例
+func HealthyInstances(instances []*ServiceInstance) []*ServiceInstance {
+	healthy := make([]*ServiceInstance, 0, len(instances))
+	for _, instance := range instances {
+		if instance.Healthy() {
+			healthy = append(healthy, instance)
+		}
+	}
+	return healthy
+}
+
+//consul返回的单个健康检查结果
+type checkStatus struct {
+	CheckID string `json:"CheckID"`
+	Status  string `json:"Status"`
+}
+
+//按照consul的规则聚合多个健康检查的状态：维护 > 严重 > 警告 > 通过
+func aggregatedStatus(checks []checkStatus) string {
+	var passing, warning, critical, maintenance bool
+	for _, check := range checks {
+		//维护模式通过特殊的检查ID表示
+		if check.CheckID == "_node_maintenance" || strings.HasPrefix(check.CheckID, "_service_maintenance:") {
+			maintenance = true
+			continue
+		}
+		switch check.Status {
+		case HealthPassing:
+			passing = true
+		case HealthWarning:
+			warning = true
+		case HealthCritical:
+			critical = true
+		default:
+			return ""
+		}
+	}
+	switch {
+	case maintenance:
+		return HealthMaintenance
+	case critical:
+		return HealthCritical
+	case warning:
+		return HealthWarning
+	case passing:
+		return HealthPassing
+	default:
+		return HealthPassing
+	}
+}
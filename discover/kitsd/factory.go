@@ -0,0 +1,33 @@
+package kitsd
+
+import (
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/sd"
+	"github.com/go-kit/kit/sd/lb"
+	kithttp "github.com/go-kit/kit/transport/http"
+	"io"
+	"net/url"
+	"time"
+)
+
+//为发现的服务实例创建HTTP客户端endpoint
+
+//返回的sd.Factory为每个实例创建kithttp.NewClient的endpoint，
+//请求地址为scheme://host:port+path，path中随请求变化的部分可以在enc中修改req.URL.Path
+func NewHTTPFactory(method, scheme, path string, enc kithttp.EncodeRequestFunc, dec kithttp.DecodeResponseFunc, options ...kithttp.ClientOption) sd.Factory {
+	return func(instance string) (endpoint.Endpoint, io.Closer, error) {
+		tgt, err := url.Parse(scheme + "://" + instance + path)
+		if err != nil {
+			return nil, nil, err
+		}
+		return kithttp.NewClient(method, tgt, enc, dec, options...).Endpoint(), nil, nil
+	}
+}
+
+//创建带负载均衡和重试的endpoint：轮询选择实例，失败后重试，最多retryMax次，总耗时不超过timeout
+func NewRetryEndpoint(instancer sd.Instancer, factory sd.Factory, logger log.Logger, retryMax int, timeout time.Duration) endpoint.Endpoint {
+	endpointer := sd.NewEndpointer(instancer, factory, logger)
+	balancer := lb.NewRoundRobin(endpointer)
+	return lb.Retry(retryMax, timeout, balancer)
+}
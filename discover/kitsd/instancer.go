@@ -0,0 +1,103 @@
+package kitsd
+
+import (
+	"context"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/sd"
+	"gomicro-discover/discover"
+	"net"
+	"strconv"
+	"sync"
+)
+
+//将discover.Client适配为go-kit的sd.Instancer，实例列表来自Client的订阅（即其缓存或watch），
+//从而可以直接使用sd.NewEndpointer、lb.NewRoundRobin、lb.Retry等go-kit组件
+
+type Instancer struct {
+	cancel context.CancelFunc
+	logger log.Logger
+	mutex  sync.Mutex
+	//已注册的接收者
+	registry map[chan<- sd.Event]struct{}
+	//最近一次的事件
+	state    sd.Event
+	hasState bool
+}
+
+var _ sd.Instancer = (*Instancer)(nil)
+
+//订阅serviceName的实例变化，opts指定订阅的数据中心和一致性模式，并用于按标签、元数据过滤实例
+func NewInstancer(client discover.Client, serviceName string, logger log.Logger, opts ...discover.QueryOption) (*Instancer, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	events, err := client.Subscribe(ctx, serviceName, opts...)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	instancer := &Instancer{
+		cancel:   cancel,
+		logger:   log.With(logger, "service", serviceName),
+		registry: make(map[chan<- sd.Event]struct{}),
+	}
+	go instancer.loop(events, opts)
+	return instancer, nil
+}
+
+//将订阅到的事件转换为sd.Event并广播给所有接收者
+func (i *Instancer) loop(events <-chan discover.Event, opts []discover.QueryOption) {
+	for event := range events {
+		//监控出错时保留最近一次的实例，go-kit的Endpointer会继续使用
+		if event.Err != nil {
+			i.logger.Log("err", event.Err)
+			i.update(sd.Event{Err: event.Err})
+			continue
+		}
+		//没有满足条件的实例时推送空列表
+		instances, _ := discover.FilterInstances(event.Instances, opts...)
+		i.update(sd.Event{Instances: InstanceAddresses(instances)})
+	}
+}
+
+//出错的事件带上最近一次的实例，与go-kit的instance.Cache一致，出错之后注册的接收者同样可以得到这些实例
+func (i *Instancer) update(event sd.Event) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	if event.Err != nil {
+		event.Instances = i.state.Instances
+	}
+	i.state = event
+	i.hasState = true
+	for ch := range i.registry {
+		ch <- event
+	}
+}
+
+//注册接收者，已经有实例列表时立即推送一次
+func (i *Instancer) Register(ch chan<- sd.Event) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	i.registry[ch] = struct{}{}
+	if i.hasState {
+		ch <- i.state
+	}
+}
+
+func (i *Instancer) Deregister(ch chan<- sd.Event) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	delete(i.registry, ch)
+}
+
+//停止订阅
+func (i *Instancer) Stop() {
+	i.cancel()
+}
+
+//将服务实例转换为go-kit使用的host:port形式
+func InstanceAddresses(instances []*discover.ServiceInstance) []string {
+	addresses := make([]string, len(instances))
+	for i, instance := range instances {
+		addresses[i] = net.JoinHostPort(instance.Address, strconv.Itoa(instance.Port))
+	}
+	return addresses
+}
@@ -0,0 +1,62 @@
+package kitsd_test
+
+import (
+	"context"
+	"errors"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/sd"
+	"gomicro-discover/discover"
+	"gomicro-discover/discover/kitsd"
+	"strings"
+	"testing"
+	"time"
+)
+
+//由测试推送事件的订阅
+type eventClient struct {
+	discover.Client
+	events chan discover.Event
+}
+
+func (c *eventClient) Subscribe(ctx context.Context, serviceName string, opts ...discover.QueryOption) (<-chan discover.Event, error) {
+	return c.events, nil
+}
+
+func receive(t *testing.T, ch <-chan sd.Event) sd.Event {
+	t.Helper()
+	select {
+	case event := <-ch:
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for event")
+		return sd.Event{}
+	}
+}
+
+//监控出错后注册的接收者仍然得到最近一次的实例
+func TestInstancerKeepsInstancesOnError(t *testing.T) {
+	client := &eventClient{events: make(chan discover.Event)}
+	instancer, err := kitsd.NewInstancer(client, "string", log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer instancer.Stop()
+	first := make(chan sd.Event, 4)
+	instancer.Register(first)
+	client.events <- discover.Event{Instances: []*discover.ServiceInstance{{ID: "string-1", Address: "127.0.0.1", Port: 10085}}}
+	if event := receive(t, first); strings.Join(event.Instances, ",") != "127.0.0.1:10085" {
+		t.Fatalf("event = %+v, want 127.0.0.1:10085", event)
+	}
+
+	errWatch := errors.New("consul unreachable")
+	client.events <- discover.Event{Err: errWatch}
+	event := receive(t, first)
+	//出错的事件处理完成后注册
+	late := make(chan sd.Event, 1)
+	instancer.Register(late)
+	for _, event := range []sd.Event{event, receive(t, late)} {
+		if event.Err != errWatch || strings.Join(event.Instances, ",") != "127.0.0.1:10085" {
+			t.Fatalf("event = %+v, want the error with the last instances", event)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package discover
+
+import (
+	"context"
+	"log"
+)
+
+//将Client适配为旧的DiscoveryClient接口，便于仍在使用旧接口的调用方平滑迁移
+
+type legacyClient struct {
+	client Client
+}
+
+func NewLegacyClient(client Client) DiscoveryClient {
+	return &legacyClient{client: client}
+}
+
+func (l *legacyClient) Register(serviceName, instanceId, healthCheckUrl string, instanceHost string, instancePort int, meta map[string]string, logger *log.Logger) bool {
+	err := l.client.Register(context.Background(), &Registration{
+		ServiceName:    serviceName,
+		InstanceId:     instanceId,
+		InstanceHost:   instanceHost,
+		InstancePort:   instancePort,
+		HealthCheckUrl: healthCheckUrl,
+		Meta:           meta,
+	})
+	if err != nil {
+		logPrintln(logger, "Register Service Error:", err)
+		return false
+	}
+	logPrintln(logger, "Register Service Success")
+	return true
+}
+
+func (l *legacyClient) Deregister(instanceId string, logger *log.Logger) bool {
+	err := l.client.Deregister(context.Background(), instanceId)
+	if err != nil {
+		logPrintln(logger, "Deregister Service Error:", err)
+		return false
+	}
+	logPrintln(logger, "Deregister Service Success")
+	return true
+}
+
+func (l *legacyClient) DiscoverService(serviceName string, logger *log.Logger) []interface{} {
+	instances, err := l.client.DiscoverService(context.Background(), serviceName)
+	if err != nil {
+		logPrintln(logger, "Discover Service Error:", err)
+		return nil
+	}
+	//旧接口返回[]interface{}，元素统一为*ServiceInstance
+	result := make([]interface{}, len(instances))
+	for i, instance := range instances {
+		result[i] = instance
+	}
+	return result
+}
+
+//logger为空时使用标准库默认的logger
+func logPrintln(logger *log.Logger, v ...interface{}) {
+	if logger == nil {
+		log.Println(v...)
+		return
+	}
+	logger.Println(v...)
+}
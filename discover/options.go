@@ -0,0 +1,171 @@
+package discover
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+//服务发现客户端的配置项，NewHTTPDiscoverClient和consulapi.NewKitDiscoverClient共用
+
+type clientOptions struct {
+	idleTimeout time.Duration
+	token       string //ACL token
+	tokenFile   string //保存ACL token的文件
+	tls         *TLSConfig
+	//本地快照文件和返回过期数据的最长时间
+	snapshotPath string
+	maxStale     time.Duration
+	//默认的一致性模式
+	consistency Consistency
+}
+
+//连接consul的TLS配置
+type TLSConfig struct {
+	CAFile             string //用于校验consul证书的CA文件
+	CertFile           string //客户端证书
+	KeyFile            string //客户端私钥
+	ServerName         string //校验证书时使用的服务器名，为空时使用consul的host
+	InsecureSkipVerify bool   //不校验consul的证书，仅用于测试
+}
+
+type ClientOption func(*clientOptions)
+
+//没有订阅者的监控在多久没有被查询之后自动停止
+func WithIdleTimeout(timeout time.Duration) ClientOption {
+	return func(o *clientOptions) {
+		o.idleTimeout = timeout
+	}
+}
+
+//使用ACL token访问consul，优先级高于WithTokenFile和环境变量CONSUL_HTTP_TOKEN
+func WithToken(token string) ClientOption {
+	return func(o *clientOptions) {
+		o.token = token
+	}
+}
+
+//从文件中读取ACL token，优先级高于环境变量CONSUL_HTTP_TOKEN
+func WithTokenFile(path string) ClientOption {
+	return func(o *clientOptions) {
+		o.tokenFile = path
+	}
+}
+
+//使用https访问consul
+func WithTLS(config TLSConfig) ClientOption {
+	return func(o *clientOptions) {
+		o.tls = &config
+	}
+}
+
+//将最近一次从consul获取的服务实例保存到本地快照文件，启动时读取。consul不可达时返回之前获取的实例
+//或快照中的实例并标记为过期，过期时间超过maxStale后返回错误，maxStale为0时不限制
+func WithSnapshot(path string, maxStale time.Duration) ClientOption {
+	return func(o *clientOptions) {
+		o.snapshotPath = path
+		o.maxStale = maxStale
+	}
+}
+
+func newClientOptions(opts []ClientOption) *clientOptions {
+	options := &clientOptions{
+		idleTimeout: defaultIdleTimeout,
+	}
+	for _, opt := range opts {
+		opt(options)
+	}
+	return options
+}
+
+//按照 参数 > 文件 > 环境变量 的顺序确定ACL token
+func (o *clientOptions) resolveToken() (string, error) {
+	if o.token != "" {
+		return o.token, nil
+	}
+	if o.tokenFile != "" {
+		data, err := ioutil.ReadFile(o.tokenFile)
+		if err != nil {
+			return "", fmt.Errorf("read consul token file: %w", err)
+		}
+		return strings.TrimSpace(string(data)), nil
+	}
+	return os.Getenv("CONSUL_HTTP_TOKEN"), nil
+}
+
+//解析后的客户端配置，供discover包之外的客户端实现使用，如consulapi包中基于consul api的客户端
+type ClientConfig struct {
+	Token       string     //按 参数 > 文件 > 环境变量 的顺序确定的ACL token
+	TLS         *TLSConfig //为nil时不使用TLS
+	IdleTimeout time.Duration
+	//本地快照文件和返回过期数据的最长时间
+	SnapshotPath string
+	MaxStale     time.Duration
+	//默认的一致性模式
+	Consistency Consistency
+}
+
+//解析配置项，读取token文件失败时返回错误
+func NewClientConfig(opts ...ClientOption) (*ClientConfig, error) {
+	return newClientOptions(opts).config()
+}
+
+func (o *clientOptions) config() (*ClientConfig, error) {
+	token, err := o.resolveToken()
+	if err != nil {
+		return nil, err
+	}
+	return &ClientConfig{
+		Token:        token,
+		TLS:          o.tls,
+		IdleTimeout:  o.idleTimeout,
+		SnapshotPath: o.snapshotPath,
+		MaxStale:     o.maxStale,
+		Consistency:  o.consistency,
+	}, nil
+}
+
+//访问consul使用的协议
+func (c *ClientConfig) Scheme() string {
+	if c.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+//根据TLS配置创建tls.Config，没有配置TLS时返回nil
+func (c *ClientConfig) TLSClientConfig(host string) (*tls.Config, error) {
+	if c.TLS == nil {
+		return nil, nil
+	}
+	config := &tls.Config{
+		ServerName:         c.TLS.ServerName,
+		InsecureSkipVerify: c.TLS.InsecureSkipVerify,
+	}
+	if config.ServerName == "" {
+		config.ServerName = host
+	}
+	if c.TLS.CAFile != "" {
+		data, err := ioutil.ReadFile(c.TLS.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read consul ca file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in consul ca file %s", c.TLS.CAFile)
+		}
+		config.RootCAs = pool
+	}
+	if c.TLS.CertFile != "" || c.TLS.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.TLS.CertFile, c.TLS.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load consul client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
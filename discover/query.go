@@ -0,0 +1,177 @@
+package discover
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+//服务发现的查询条件
+
+type QueryOptions struct {
+	Tags       []string          //服务实例必须包含全部标签
+	Meta       map[string]string //服务实例元数据必须匹配全部键值
+	Datacenter string            //查询的数据中心，为空时查询本地数据中心
+	Failover   []string          //没有可用实例时按顺序依次查询的数据中心
+	//读取的一致性模式，Mode为空时使用客户端的默认模式
+	Consistency Consistency
+	//不为nil时写入查询结果的元信息
+	queryMeta *QueryMeta
+}
+
+//查询结果的元信息，通过WithQueryMeta获取
+type QueryMeta struct {
+	Stale        bool          //结果是否为过期的数据，即consul不可达时返回的之前获取的实例或本地快照
+	Age          time.Duration //过期的数据距离最近一次从consul成功获取的时间，Stale为false时为0
+	FromSnapshot bool          //结果是否来自本地快照
+	//结果是否直接来自已有监控的缓存，为false时本次查询等待了新监控的第一次查询
+	Cached bool
+	//最近一次查询时处理请求的server距离最近一次与leader通信的时间，即X-Consul-LastContact，只在stale模式下可能大于0
+	LastContact time.Duration
+	//最近一次查询时consul集群是否有leader，即X-Consul-KnownLeader
+	KnownLeader bool
+}
+
+type QueryOption func(*QueryOptions)
+
+//按标签过滤，可以指定多个，实例需要同时包含
+func WithTags(tags ...string) QueryOption {
+	return func(o *QueryOptions) {
+		o.Tags = append(o.Tags, tags...)
+	}
+}
+
+//按元数据过滤，实例元数据中key对应的值必须等于value
+func WithMeta(key, value string) QueryOption {
+	return func(o *QueryOptions) {
+		if o.Meta == nil {
+			o.Meta = make(map[string]string)
+		}
+		o.Meta[key] = value
+	}
+}
+
+//查询指定的数据中心
+func WithDatacenter(dc string) QueryOption {
+	return func(o *QueryOptions) {
+		o.Datacenter = dc
+	}
+}
+
+//指定的数据中心没有满足条件的可用实例时，按顺序查询这些数据中心，一般按距离由近到远排列
+func WithFailover(dcs ...string) QueryOption {
+	return func(o *QueryOptions) {
+		o.Failover = append(o.Failover, dcs...)
+	}
+}
+
+//查询完成后将结果的元信息写入meta，查询失败时同样写入，此时只有Cached等已经确定的字段有效
+func WithQueryMeta(meta *QueryMeta) QueryOption {
+	return func(o *QueryOptions) {
+		o.queryMeta = meta
+	}
+}
+
+//写入查询结果的元信息，没有通过WithQueryMeta指定时忽略，供自定义的Client实现使用
+func (o *QueryOptions) SetQueryMeta(meta QueryMeta) {
+	if o.queryMeta != nil {
+		*o.queryMeta = meta
+	}
+}
+
+//依次查询的数据中心，第一个为指定的数据中心（为空时表示本地数据中心），去掉重复的数据中心
+func (o *QueryOptions) Datacenters() []string {
+	dcs := []string{o.Datacenter}
+	seen := map[string]bool{o.Datacenter: true}
+	for _, dc := range o.Failover {
+		if !seen[dc] {
+			seen[dc] = true
+			dcs = append(dcs, dc)
+		}
+	}
+	return dcs
+}
+
+//解析形如version=2的元数据选择器
+func ParseMetaSelector(selector string) (QueryOption, error) {
+	parts := strings.SplitN(selector, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return nil, fmt.Errorf("invalid meta selector %q, expected key=value", selector)
+	}
+	return WithMeta(parts[0], parts[1]), nil
+}
+
+//合并查询条件，供自定义的Client实现使用
+func NewQueryOptions(opts ...QueryOption) *QueryOptions {
+	return newQueryOptions(opts)
+}
+
+func newQueryOptions(opts []QueryOption) *QueryOptions {
+	options := &QueryOptions{}
+	for _, opt := range opts {
+		opt(options)
+	}
+	return options
+}
+
+//判断服务实例是否满足查询条件
+func (o *QueryOptions) match(instance *ServiceInstance) bool {
+	for _, tag := range o.Tags {
+		if !containsTag(instance.Tags, tag) {
+			return false
+		}
+	}
+	for key, value := range o.Meta {
+		if v, ok := instance.Meta[key]; !ok || v != value {
+			return false
+		}
+	}
+	return true
+}
+
+//过滤出满足查询条件的服务实例，没有实例满足时返回ErrServiceNotFound
+func (o *QueryOptions) filter(instances []*ServiceInstance) ([]*ServiceInstance, error) {
+	if len(o.Tags) == 0 && len(o.Meta) == 0 {
+		return cachedInstances(instances)
+	}
+	matched := make([]*ServiceInstance, 0, len(instances))
+	for _, instance := range instances {
+		if o.match(instance) {
+			matched = append(matched, instance)
+		}
+	}
+	return cachedInstances(matched)
+}
+
+func containsTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+//按查询条件过滤服务实例，没有实例满足时返回ErrServiceNotFound，供自定义的Client实现使用
+func FilterInstances(instances []*ServiceInstance, opts ...QueryOption) ([]*ServiceInstance, error) {
+	return newQueryOptions(opts).filter(instances)
+}
+
+//将逗号分隔的标签拆分为列表，忽略空标签，用于从命令行参数中读取注册标签
+func ParseTags(tags string) []string {
+	var result []string
+	for _, tag := range strings.Split(tags, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			result = append(result, tag)
+		}
+	}
+	return result
+}
+
+//缓存中没有服务实例时返回ErrServiceNotFound
+func cachedInstances(instances []*ServiceInstance) ([]*ServiceInstance, error) {
+	if len(instances) == 0 {
+		return nil, ErrServiceNotFound
+	}
+	return instances, nil
+}
@@ -0,0 +1,302 @@
+package discover
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+//带重试的服务注册：注册失败时按指数退避加随机抖动重试，注册成功后在后台定期检查实例是否仍然注册，
+//consul agent重启等原因丢失注册时自动重新注册
+
+//服务实例的注册状态
+type RegistrationState string
+
+const (
+	RegistrationPending      RegistrationState = "registering"  //正在注册或等待重试
+	RegistrationRegistered   RegistrationState = "registered"   //已注册
+	RegistrationFailed       RegistrationState = "failed"       //注册信息无效，不会重试
+	RegistrationMaintenance  RegistrationState = "maintenance"  //维护模式，不再接收新的流量
+	RegistrationDeregistered RegistrationState = "deregistered" //已注销
+)
+
+const (
+	defaultRegisterRetryMin  = time.Second
+	defaultRegisterRetryMax  = 30 * time.Second
+	defaultReconcileInterval = 30 * time.Second
+	//单次注册请求的超时时间
+	registerTimeout = 10 * time.Second
+)
+
+//注册状态，用于在/health中展示
+type RegistrationStatus struct {
+	InstanceId      string            `json:"instance_id"`
+	State           RegistrationState `json:"state"`
+	Attempts        int               `json:"attempts"`        //当前一轮注册的尝试次数
+	Reregistrations int               `json:"reregistrations"` //发现注册丢失后重新注册的次数
+	RegisteredAt    time.Time         `json:"registered_at"`   //最近一次注册成功的时间
+	LastCheck       time.Time         `json:"last_check"`      //最近一次检查注册状态的时间
+	LastError       string            `json:"last_error,omitempty"`
+}
+
+type Registrar struct {
+	client       Client
+	registration *Registration
+	logger       *log.Logger
+	retryMin     time.Duration
+	retryMax     time.Duration
+	interval     time.Duration
+
+	mutex  sync.Mutex
+	status RegistrationStatus
+
+	startOnce sync.Once
+	stopOnce  sync.Once
+	stop      chan struct{}
+	done      chan struct{}
+}
+
+type RegistrarOption func(*Registrar)
+
+//注册失败后的重试间隔从min开始每次翻倍，最大为max，实际间隔在[d/2, d]之间随机
+func WithRegisterBackoff(min, max time.Duration) RegistrarOption {
+	return func(r *Registrar) {
+		r.retryMin, r.retryMax = min, max
+	}
+}
+
+//检查实例是否仍然注册的间隔，不大于0时不检查
+func WithReconcileInterval(interval time.Duration) RegistrarOption {
+	return func(r *Registrar) {
+		r.interval = interval
+	}
+}
+
+//记录注册过程的logger，默认使用标准库默认的logger
+func WithRegistrarLogger(logger *log.Logger) RegistrarOption {
+	return func(r *Registrar) {
+		r.logger = logger
+	}
+}
+
+func NewRegistrar(client Client, registration *Registration, opts ...RegistrarOption) *Registrar {
+	r := &Registrar{
+		client:       client,
+		registration: registration,
+		retryMin:     defaultRegisterRetryMin,
+		retryMax:     defaultRegisterRetryMax,
+		interval:     defaultReconcileInterval,
+		status: RegistrationStatus{
+			InstanceId: registration.InstanceId,
+			State:      RegistrationPending,
+		},
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	if r.retryMin <= 0 {
+		r.retryMin = defaultRegisterRetryMin
+	}
+	if r.retryMax < r.retryMin {
+		r.retryMax = r.retryMin
+	}
+	return r
+}
+
+//在后台注册服务实例并保持注册，多次调用只启动一次
+func (r *Registrar) Start() {
+	r.startOnce.Do(func() {
+		go r.run()
+	})
+}
+
+//当前的注册状态
+func (r *Registrar) Status() RegistrationStatus {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.status
+}
+
+func (r *Registrar) Registered() bool {
+	return r.Status().State == RegistrationRegistered
+}
+
+//停止重试和检查，将服务实例置为维护模式，用于退出前摘除流量。客户端不支持时返回ErrMaintenanceUnsupported
+func (r *Registrar) EnterMaintenance(ctx context.Context, reason string) error {
+	r.halt()
+	setter, ok := r.client.(MaintenanceSetter)
+	if !ok {
+		return ErrMaintenanceUnsupported
+	}
+	if err := setter.SetMaintenance(ctx, r.registration.InstanceId, true, reason); err != nil {
+		return err
+	}
+	r.setState(RegistrationMaintenance, nil)
+	return nil
+}
+
+//停止重试和检查，注册成功过时注销服务实例。实例已经不在agent上时不返回错误
+func (r *Registrar) Deregister(ctx context.Context) error {
+	r.halt()
+	r.mutex.Lock()
+	registered := !r.status.RegisteredAt.IsZero()
+	r.mutex.Unlock()
+	if !registered {
+		return nil
+	}
+	err := r.client.Deregister(ctx, r.registration.InstanceId)
+	if errors.Is(err, ErrServiceNotFound) {
+		err = nil
+	}
+	if err == nil {
+		r.setState(RegistrationDeregistered, nil)
+	}
+	return err
+}
+
+//停止后台的注册和检查，避免退出过程中重新注册
+func (r *Registrar) halt() {
+	r.stopOnce.Do(func() {
+		close(r.stop)
+	})
+	started := true
+	r.startOnce.Do(func() {
+		started = false
+	})
+	if started {
+		<-r.done
+	}
+}
+
+func (r *Registrar) run() {
+	defer close(r.done)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-r.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	if !r.register(ctx) {
+		return
+	}
+	//客户端不支持查询注册状态时无法检查
+	checker, ok := r.client.(RegistrationChecker)
+	if !ok || r.interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		if !r.reconcile(ctx, checker) {
+			return
+		}
+	}
+}
+
+//注册直到成功，ctx结束或注册信息无效时返回false
+func (r *Registrar) register(ctx context.Context) bool {
+	for attempt := 1; ; attempt++ {
+		r.mutex.Lock()
+		r.status.State = RegistrationPending
+		r.status.Attempts = attempt
+		r.mutex.Unlock()
+
+		registerCtx, cancel := context.WithTimeout(ctx, registerTimeout)
+		err := r.client.Register(registerCtx, r.registration)
+		cancel()
+		if err == nil {
+			r.mutex.Lock()
+			r.status.State = RegistrationRegistered
+			r.status.RegisteredAt = time.Now()
+			r.status.LastError = ""
+			r.mutex.Unlock()
+			r.logf("register instance %s of service %s succeeded after %d attempt(s)", r.registration.InstanceId, r.registration.ServiceName, attempt)
+			return true
+		}
+		if ctx.Err() != nil {
+			return false
+		}
+		if errors.Is(err, ErrInvalidRegistration) {
+			r.setState(RegistrationFailed, err)
+			r.logf("register instance %s failed permanently: %v", r.registration.InstanceId, err)
+			return false
+		}
+		r.setState(RegistrationPending, err)
+		delay := r.backoff(attempt)
+		r.logf("register instance %s failed: %v, retry in %s", r.registration.InstanceId, err, delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+//检查实例是否仍然注册，丢失时重新注册，ctx结束时返回false
+func (r *Registrar) reconcile(ctx context.Context, checker RegistrationChecker) bool {
+	checkCtx, cancel := context.WithTimeout(ctx, registerTimeout)
+	registered, err := checker.Registered(checkCtx, r.registration.InstanceId)
+	cancel()
+	if ctx.Err() != nil {
+		return false
+	}
+	r.mutex.Lock()
+	r.status.LastCheck = time.Now()
+	r.status.LastError = errorString(err)
+	r.mutex.Unlock()
+	if err != nil {
+		//agent不可用时无法判断，等待下一次检查
+		r.logf("check registration of instance %s failed: %v", r.registration.InstanceId, err)
+		return true
+	}
+	if registered {
+		return true
+	}
+	r.logf("instance %s is no longer registered, registering again", r.registration.InstanceId)
+	r.mutex.Lock()
+	r.status.Reregistrations++
+	r.mutex.Unlock()
+	return r.register(ctx)
+}
+
+//第attempt次失败后的等待时间，在指数退避的基础上加入随机抖动，避免大量实例同时重试
+func (r *Registrar) backoff(attempt int) time.Duration {
+	delay := r.retryMin
+	for i := 1; i < attempt && delay < r.retryMax; i++ {
+		delay *= 2
+	}
+	if delay > r.retryMax {
+		delay = r.retryMax
+	}
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(delay-half)+1))
+}
+
+func (r *Registrar) setState(state RegistrationState, err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.status.State = state
+	r.status.LastError = errorString(err)
+}
+
+func (r *Registrar) logf(format string, args ...interface{}) {
+	if r.logger != nil {
+		r.logger.Printf(format, args...)
+		return
+	}
+	log.Printf(format, args...)
+}
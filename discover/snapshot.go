@@ -0,0 +1,143 @@
+package discover
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+)
+
+//服务实例的本地快照：监控每次从consul成功获取数据后写入文件，进程启动时读取。
+//consul不可达且还没有从consul获取过数据时返回快照中的实例，避免consul故障期间启动的进程拒绝全部下游调用
+
+//数据没有变化时两次写入快照的最小间隔，只需要刷新时间戳
+const snapshotRefreshInterval = time.Minute
+
+//单个服务在快照中的数据
+type snapshotEntry struct {
+	ServiceName string             `json:"service_name"`
+	Datacenter  string             `json:"datacenter,omitempty"`
+	Instances   []*ServiceInstance `json:"instances"`
+	UpdatedAt   time.Time          `json:"updated_at"` //最近一次从consul成功获取的时间
+}
+
+type snapshotFile struct {
+	SavedAt  time.Time       `json:"saved_at"`
+	Services []snapshotEntry `json:"services"`
+}
+
+type snapshotStore struct {
+	path    string
+	mutex   sync.Mutex
+	entries map[WatchKey]snapshotEntry
+	saved   map[WatchKey]time.Time //每个服务最近一次写入文件的时间
+}
+
+//读取快照文件，path为空时返回nil表示不使用快照。文件不存在时返回空的快照，
+//文件损坏时同样返回空的快照和错误，之后的写入会覆盖损坏的文件
+func loadSnapshot(path string) (*snapshotStore, error) {
+	if path == "" {
+		return nil, nil
+	}
+	s := &snapshotStore{
+		path:    path,
+		entries: make(map[WatchKey]snapshotEntry),
+		saved:   make(map[WatchKey]time.Time),
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return s, fmt.Errorf("read discovery snapshot: %w", err)
+	}
+	var file snapshotFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return s, fmt.Errorf("parse discovery snapshot %s: %w", path, err)
+	}
+	for _, entry := range file.Services {
+		s.entries[WatchKey{ServiceName: entry.ServiceName, Datacenter: entry.Datacenter}] = entry
+	}
+	return s, nil
+}
+
+//快照中服务的数据
+func (s *snapshotStore) lookup(key WatchKey) (snapshotEntry, bool) {
+	if s == nil {
+		return snapshotEntry{}, false
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	entry, ok := s.entries[snapshotKey(key)]
+	return entry, ok
+}
+
+//记录服务最新的实例并写入文件，实例没有变化时按snapshotRefreshInterval限制写入频率。
+//没有可用实例时不写入，保留最近一次可用的实例，避免全部实例短暂不可用时覆盖快照
+func (s *snapshotStore) save(key WatchKey, instances []*ServiceInstance, updatedAt time.Time) error {
+	if s == nil || len(instances) == 0 {
+		return nil
+	}
+	key = snapshotKey(key)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	old, ok := s.entries[key]
+	if ok && reflect.DeepEqual(old.Instances, instances) && updatedAt.Sub(s.saved[key]) < snapshotRefreshInterval {
+		return nil
+	}
+	s.entries[key] = snapshotEntry{
+		ServiceName: key.ServiceName,
+		Datacenter:  key.Datacenter,
+		Instances:   instances,
+		UpdatedAt:   updatedAt,
+	}
+	s.saved[key] = updatedAt
+	return s.write()
+}
+
+//快照只按服务名和数据中心保存，不同一致性模式的监控共用同一份数据
+func snapshotKey(key WatchKey) WatchKey {
+	return WatchKey{ServiceName: key.ServiceName, Datacenter: key.Datacenter}
+}
+
+//先写入临时文件再重命名，避免进程在写入过程中退出时留下不完整的快照。需要持有锁
+func (s *snapshotStore) write() error {
+	file := snapshotFile{
+		SavedAt:  time.Now(),
+		Services: make([]snapshotEntry, 0, len(s.entries)),
+	}
+	for _, entry := range s.entries {
+		file.Services = append(file.Services, entry)
+	}
+	sort.Slice(file.Services, func(i, j int) bool {
+		if file.Services[i].ServiceName != file.Services[j].ServiceName {
+			return file.Services[i].ServiceName < file.Services[j].ServiceName
+		}
+		return file.Services[i].Datacenter < file.Services[j].Datacenter
+	})
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("write discovery snapshot: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write discovery snapshot: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("write discovery snapshot: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return fmt.Errorf("write discovery snapshot: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,370 @@
+package discover
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+//管理后台监控协程的生命周期：按服务名共享监控，订阅时增加引用计数，
+//没有订阅者且长时间没有被查询的监控会被自动停止，客户端关闭时停止全部监控
+
+const (
+	//监控空闲多久之后被停止
+	defaultIdleTimeout = 10 * time.Minute
+	//阻塞查询失败后的重试间隔
+	watchRetryMin = time.Second
+	watchRetryMax = time.Minute
+)
+
+//监控的标识，同一个服务在不同数据中心、使用不同一致性模式的监控相互独立
+type WatchKey struct {
+	ServiceName string
+	Datacenter  string //为空时表示本地数据中心
+	Consistency Consistency
+}
+
+//查询服务的可用实例，由具体的客户端实现。index大于0时为阻塞查询，直到数据变化或等待超时才返回
+type FetchFunc func(ctx context.Context, key WatchKey, index uint64) ([]*ServiceInstance, ResponseMeta, error)
+
+//正在运行的监控信息
+type WatchInfo struct {
+	ServiceName string    `json:"service_name"` //服务名
+	Datacenter  string    `json:"datacenter"`   //数据中心，为空时表示本地数据中心
+	Consistency string    `json:"consistency"`  //一致性模式
+	Subscribers int       `json:"subscribers"`  //当前的订阅者数量
+	Instances   int       `json:"instances"`    //缓存的可用实例数量
+	LastUsed    time.Time `json:"last_used"`    //最近一次被查询或订阅的时间
+	LastUpdate  time.Time `json:"last_update"`  //最近一次成功更新的时间
+	Error       string    `json:"error,omitempty"`
+	//连续查询失败的开始时间，期间返回的是该时间之前的缓存数据
+	FailingSince time.Time `json:"failing_since"`
+}
+
+//可以列出正在运行的监控的客户端
+type WatchLister interface {
+	Watches() []WatchInfo
+}
+
+type serviceWatch struct {
+	cache    *serviceCache
+	refs     int       //订阅者数量
+	lastUsed time.Time //最近一次被使用的时间
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+//监控集合的配置
+type watchConfig struct {
+	idleTimeout time.Duration
+	//本地快照，为nil时不使用
+	snapshot *snapshotStore
+	//consul不可达时返回过期数据的最长时间，为0时不限制
+	maxStale time.Duration
+	//查询没有指定一致性模式时使用的模式
+	consistency Consistency
+}
+
+//按服务管理的监控和缓存，DiscoverService、Subscribe等查询都由缓存处理，
+//监控协程通过FetchFunc发起阻塞查询更新缓存
+type WatchSet struct {
+	mutex sync.Mutex
+	fetch FetchFunc
+	watchConfig
+	watches    map[WatchKey]*serviceWatch
+	closed     bool
+	reaperStop chan struct{}
+}
+
+//创建监控集合，config中的快照文件损坏时只记录错误，之后的写入会覆盖它
+func NewWatchSet(fetch FetchFunc, config *ClientConfig) *WatchSet {
+	snapshot, err := loadSnapshot(config.SnapshotPath)
+	if err != nil {
+		log.Printf("load discovery snapshot failed: %v", err)
+	}
+	idleTimeout := config.IdleTimeout
+	if idleTimeout <= 0 {
+		idleTimeout = defaultIdleTimeout
+	}
+	return &WatchSet{
+		fetch: fetch,
+		watchConfig: watchConfig{
+			idleTimeout: idleTimeout,
+			snapshot:    snapshot,
+			maxStale:    config.MaxStale,
+			consistency: config.Consistency.resolve(Consistency{}),
+		},
+		watches:    make(map[WatchKey]*serviceWatch),
+		reaperStop: make(chan struct{}),
+	}
+}
+
+//获取服务的监控，不存在时启动新的监控协程
+func (ws *WatchSet) acquire(key WatchKey, subscribe bool) (*serviceWatch, error) {
+	ws.mutex.Lock()
+	defer ws.mutex.Unlock()
+	if ws.closed {
+		return nil, ErrClientClosed
+	}
+	w, ok := ws.watches[key]
+	if !ok {
+		//第一个监控启动时同时启动空闲清理协程
+		if len(ws.watches) == 0 {
+			go ws.reap()
+		}
+		w = &serviceWatch{
+			cache: newServiceCache(),
+			stop:  make(chan struct{}),
+			done:  make(chan struct{}),
+		}
+		if ws.snapshot != nil {
+			if entry, ok := ws.snapshot.lookup(key); ok {
+				w.cache.restore(entry.Instances, entry.UpdatedAt)
+			}
+			w.cache.persist = func(instances []*ServiceInstance, updatedAt time.Time) {
+				if err := ws.snapshot.save(key, instances, updatedAt); err != nil {
+					log.Printf("save discovery snapshot of %s failed: %v", key.ServiceName, err)
+				}
+			}
+		}
+		ws.watches[key] = w
+		go func() {
+			defer close(w.done)
+			ws.watch(key, w.cache, w.stop)
+		}()
+	}
+	w.lastUsed = time.Now()
+	if subscribe {
+		w.refs++
+	}
+	return w, nil
+}
+
+//订阅结束时减少引用计数
+func (ws *WatchSet) release(w *serviceWatch) {
+	ws.mutex.Lock()
+	defer ws.mutex.Unlock()
+	w.refs--
+	w.lastUsed = time.Now()
+}
+
+//查询服务的缓存
+func (ws *WatchSet) get(ctx context.Context, key WatchKey) ([]*ServiceInstance, QueryMeta, error) {
+	w, err := ws.acquire(key, false)
+	if err != nil {
+		return nil, QueryMeta{}, err
+	}
+	return w.cache.get(ctx, ws.maxStale)
+}
+
+//按查询条件从缓存中查询服务实例：先查询指定的（或本地）数据中心，
+//没有满足条件的可用实例时按顺序查询故障转移列表中的数据中心，查询失败时写入返回的错误对应的元信息
+func (ws *WatchSet) Discover(ctx context.Context, serviceName string, opts ...QueryOption) ([]*ServiceInstance, error) {
+	options := newQueryOptions(opts)
+	var (
+		lastErr  error
+		lastMeta QueryMeta
+	)
+	consistency := options.Consistency.resolve(ws.consistency)
+	for _, dc := range options.Datacenters() {
+		instances, meta, err := ws.get(ctx, WatchKey{ServiceName: serviceName, Datacenter: dc, Consistency: consistency})
+		if err == nil {
+			instances, err = options.filter(instances)
+		}
+		if err == nil {
+			options.SetQueryMeta(meta)
+			return instances, nil
+		}
+		//客户端关闭或调用方取消时不再继续
+		if errors.Is(err, ErrClientClosed) || ctx.Err() != nil {
+			options.SetQueryMeta(meta)
+			return nil, err
+		}
+		//优先返回注册中心不可用等错误，而不是没有找到实例
+		if lastErr == nil || !errors.Is(err, ErrServiceNotFound) {
+			lastErr, lastMeta = err, meta
+		}
+	}
+	options.SetQueryMeta(lastMeta)
+	return nil, lastErr
+}
+
+//订阅服务的变化，ctx结束后释放引用，与相同数据中心和一致性模式的Discover共用同一个监控
+func (ws *WatchSet) Subscribe(ctx context.Context, serviceName string, opts ...QueryOption) (<-chan Event, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	options := newQueryOptions(opts)
+	key := WatchKey{ServiceName: serviceName, Datacenter: options.Datacenter, Consistency: options.Consistency.resolve(ws.consistency)}
+	w, err := ws.acquire(key, true)
+	if err != nil {
+		return nil, err
+	}
+	events := w.cache.subscribe(ctx)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-w.stop:
+		}
+		ws.release(w)
+	}()
+	return events, nil
+}
+
+//使用阻塞查询监控服务实例列表的变化，出错时按指数退避重试，直到stop被关闭
+func (ws *WatchSet) watch(key WatchKey, cache *serviceCache, stop <-chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	var index uint64
+	retry := watchRetryMin
+	for ctx.Err() == nil {
+		instances, meta, err := ws.fetch(ctx, key, index)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Println("Watch Service Error:", err)
+			cache.fail(err)
+			if !sleep(ctx, jitter(retry)) {
+				return
+			}
+			if retry *= 2; retry > watchRetryMax {
+				retry = watchRetryMax
+			}
+			continue
+		}
+		//index回退时（如consul重启）需要重新开始，index必须大于0，否则阻塞查询会立即返回
+		reset := meta.Index < index || meta.Index == 0
+		if reset {
+			meta.Index = 1
+		}
+		index = meta.Index
+		cache.update(instances, meta)
+		if !reset {
+			retry = watchRetryMin
+			continue
+		}
+		//重新开始的查询不会阻塞，等待一段时间再查询，index持续回退时按指数退避，避免不断请求consul
+		if !sleep(ctx, jitter(retry)) {
+			return
+		}
+		if retry *= 2; retry > watchRetryMax {
+			retry = watchRetryMax
+		}
+	}
+}
+
+//在[d/2, d]之间随机选择等待时间，避免大量监控同时重试
+func jitter(d time.Duration) time.Duration {
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(d-half)+1))
+}
+
+//等待d，ctx被取消时提前返回false
+func sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+//定期停止空闲的监控，没有监控时退出
+func (ws *WatchSet) reap() {
+	ticker := time.NewTicker(ws.idleTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ws.reaperStop:
+			return
+		}
+		ws.mutex.Lock()
+		var idle []*serviceWatch
+		for key, w := range ws.watches {
+			if w.refs <= 0 && time.Since(w.lastUsed) > ws.idleTimeout {
+				delete(ws.watches, key)
+				idle = append(idle, w)
+			}
+		}
+		empty := len(ws.watches) == 0
+		ws.mutex.Unlock()
+		for _, w := range idle {
+			w.close()
+		}
+		if empty {
+			return
+		}
+	}
+}
+
+//列出正在运行的监控，按服务名排序
+func (ws *WatchSet) List() []WatchInfo {
+	ws.mutex.Lock()
+	defer ws.mutex.Unlock()
+	infos := make([]WatchInfo, 0, len(ws.watches))
+	for key, w := range ws.watches {
+		w.cache.mutex.RLock()
+		info := WatchInfo{
+			ServiceName:  key.ServiceName,
+			Datacenter:   key.Datacenter,
+			Consistency:  string(key.Consistency.Mode),
+			Subscribers:  w.refs,
+			Instances:    len(w.cache.instances),
+			LastUsed:     w.lastUsed,
+			LastUpdate:   w.cache.updated,
+			Error:        errorString(w.cache.err),
+			FailingSince: w.cache.failedAt,
+		}
+		w.cache.mutex.RUnlock()
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		if infos[i].ServiceName != infos[j].ServiceName {
+			return infos[i].ServiceName < infos[j].ServiceName
+		}
+		if infos[i].Datacenter != infos[j].Datacenter {
+			return infos[i].Datacenter < infos[j].Datacenter
+		}
+		return infos[i].Consistency < infos[j].Consistency
+	})
+	return infos
+}
+
+//停止全部监控并等待监控协程退出，之后的查询返回ErrClientClosed
+func (ws *WatchSet) Close() {
+	ws.mutex.Lock()
+	if ws.closed {
+		ws.mutex.Unlock()
+		return
+	}
+	ws.closed = true
+	watches := ws.watches
+	ws.watches = make(map[WatchKey]*serviceWatch)
+	close(ws.reaperStop)
+	ws.mutex.Unlock()
+	for _, w := range watches {
+		w.close()
+	}
+}
+
+//停止监控协程，并关闭所有订阅者的channel
+func (w *serviceWatch) close() {
+	close(w.stop)
+	<-w.done
+	w.cache.close()
+}
@@ -0,0 +1,29 @@
+package discover_test
+
+import (
+	"context"
+	"gomicro-discover/discover"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+//index持续回退（每次都返回0）时，监控等待一段时间再重新查询，而不是立即重试
+func TestWatchBacksOffOnIndexReset(t *testing.T) {
+	var calls int32
+	fetch := func(ctx context.Context, key discover.WatchKey, index uint64) ([]*discover.ServiceInstance, discover.ResponseMeta, error) {
+		atomic.AddInt32(&calls, 1)
+		return []*discover.ServiceInstance{{ID: "string-1", Address: "127.0.0.1", Port: 10085}}, discover.ResponseMeta{}, nil
+	}
+	ws := discover.NewWatchSet(fetch, &discover.ClientConfig{})
+	defer ws.Close()
+	instances, err := ws.Discover(context.Background(), "string")
+	if err != nil || len(instances) != 1 {
+		t.Fatalf("Discover() = %v, %v, want 1 instance", instances, err)
+	}
+	//第一次退避至少等待watchRetryMin的一半
+	time.Sleep(300 * time.Millisecond)
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Fatalf("fetch called %d times after an index reset, want 1", n)
+	}
+}
@@ -3,7 +3,10 @@ package endpoint
 import (
 	"context"
 	"github.com/go-kit/kit/endpoint"
+	"gomicro-discover/discover"
+	"gomicro-discover/health"
 	"gomicro-discover/service"
+	"time"
 )
 
 //endpoint层需要定义返回Endpoint的构建函数，用于将请求转化为Service接口可以处理的参数
@@ -14,6 +17,7 @@ import (
 type DiscoveryEndpoint struct {
 	SayHelloEndpoint    endpoint.Endpoint
 	DiscoveryEndpoint   endpoint.Endpoint
+	LeaderEndpoint      endpoint.Endpoint
 	HealthCheckEndpoint endpoint.Endpoint
 }
 
@@ -39,12 +43,25 @@ func MakeSayHelloEndpoint(svc service.Service) endpoint.Endpoint {
 //服务发现请求结构体
 type DiscoveryRequest struct {
 	ServiceName string
+	Tags        []string          //实例需要包含的标签
+	Meta        map[string]string //实例元数据需要匹配的键值
+	Datacenter  string            //查询的数据中心，为空时查询本地数据中心
+	Failover    []string          //没有可用实例时依次查询的数据中心
+	//读取的一致性模式，为空时使用客户端的默认模式，MaxStale只在stale模式下有效
+	Consistency discover.ConsistencyMode
+	MaxStale    time.Duration
 }
 
 //服务发现响应结构体
 type DiscoveryResponse struct {
-	Instances []interface{} `json:"instances"`
-	Error     string        `json:"error"`
+	Instances []*discover.ServiceInstance `json:"instances"`
+	Error     string                      `json:"error"`
+	//consul不可达时返回的是之前获取的实例或本地快照，Age为数据距离最近一次从consul获取的时间
+	Stale bool   `json:"stale"`
+	Age   string `json:"age,omitempty"`
+	//处理查询的consul server距离最近一次与leader通信的时间，以及集群是否有leader
+	LastContact string `json:"last_contact"`
+	KnownLeader bool   `json:"known_leader"`
 }
 
 //创建服务发现的Endpoint,他是一个rpc类型的函数
@@ -52,33 +69,104 @@ func MakeDiscoveryEndpoint(svc service.Service) endpoint.Endpoint {
 	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
 		//判断request是否满足DiscoveryRequest
 		req := request.(DiscoveryRequest)
-		instances, err := svc.DiscoveryService(ctx, req.ServiceName)
+		var opts []discover.QueryOption
+		if len(req.Tags) > 0 {
+			opts = append(opts, discover.WithTags(req.Tags...))
+		}
+		for key, value := range req.Meta {
+			opts = append(opts, discover.WithMeta(key, value))
+		}
+		if req.Datacenter != "" {
+			opts = append(opts, discover.WithDatacenter(req.Datacenter))
+		}
+		if len(req.Failover) > 0 {
+			opts = append(opts, discover.WithFailover(req.Failover...))
+		}
+		if req.Consistency != "" {
+			opts = append(opts, discover.WithConsistency(req.Consistency, req.MaxStale))
+		}
+		var meta discover.QueryMeta
+		opts = append(opts, discover.WithQueryMeta(&meta))
+		instances, err := svc.DiscoveryService(ctx, req.ServiceName, opts...)
 		var errString = ""
 		if err != nil {
 			errString = err.Error()
 		}
+		var age string
+		if meta.Stale {
+			age = meta.Age.Round(time.Second).String()
+		}
 		return &DiscoveryResponse{
-			Instances: instances,
-			Error:     errString,
+			Instances:   instances,
+			Error:       errString,
+			Stale:       meta.Stale,
+			Age:         age,
+			LastContact: meta.LastContact.String(),
+			KnownLeader: meta.KnownLeader,
 		}, nil
 	}
 }
 
-//健康检查请求结构体
+//leader查询请求结构体
+type LeaderRequest struct {
+	ServiceName string
+}
+
+//leader查询响应结构体，Leader为leader的实例ID
+type LeaderResponse struct {
+	ServiceName string `json:"service_name"`
+	Leader      string `json:"leader"`
+	Error       string `json:"error"`
+}
+
+//创建查询服务leader的Endpoint
+func MakeLeaderEndpoint(svc service.Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		req := request.(LeaderRequest)
+		leader, err := svc.Leader(ctx, req.ServiceName)
+		var errString = ""
+		if err != nil {
+			errString = err.Error()
+		}
+		return &LeaderResponse{
+			ServiceName: req.ServiceName,
+			Leader:      leader,
+			Error:       errString,
+		}, nil
+	}
+}
+
+//健康检查的类型
+const (
+	ProbeLiveness  = "live"  //存活检查
+	ProbeReadiness = "ready" //就绪检查
+)
+
+//健康检查请求结构体，Probe为空时按就绪检查处理
 type HealthRequest struct {
+	Probe string
 }
 
-//健康检查响应结构体
+//健康检查响应结构体，即各个组件的健康检查报告
 type HealthResponse struct {
-	Status bool `json:"status"`
+	health.Report
 }
 
-//创建健康检查的创建服务发现的Endpoint
+//实现kithttp.StatusCoder，整体状态为fail时返回503
+func (r *HealthResponse) StatusCode() int {
+	return r.HTTPStatus()
+}
+
+//创建健康检查的Endpoint
 func MakeHealthCheckEndpoint(svc service.Service) endpoint.Endpoint {
 	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
-		status := svc.HealthCheck()
+		req := request.(HealthRequest)
+		report := svc.Readiness
+		if req.Probe == ProbeLiveness {
+			report = svc.Liveness
+		}
 		return &HealthResponse{
-			Status: status,
+			Report: report(ctx),
 		}, nil
 	}
 }
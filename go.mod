@@ -8,4 +8,5 @@ require (
 	github.com/hashicorp/consul/api v1.5.0
 	github.com/prometheus/client_golang v1.7.0
 	github.com/satori/go.uuid v1.2.0
+	go.opencensus.io v0.22.2
 )
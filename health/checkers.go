@@ -0,0 +1,123 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"gomicro-discover/discover"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//常用组件的检查
+
+//consul是否可达，不可达时本实例无法注册、上报心跳和更新服务发现的缓存
+func Consul(pinger discover.Pinger) Checker {
+	return CheckerFunc(func(ctx context.Context) Result {
+		if err := pinger.Ping(ctx); err != nil {
+			return Fail(err.Error())
+		}
+		return Pass("reachable")
+	})
+}
+
+//过期的监控
+type staleWatch struct {
+	ServiceName  string    `json:"service_name"`
+	Datacenter   string    `json:"datacenter,omitempty"`
+	Error        string    `json:"error"`
+	FailingSince time.Time `json:"failing_since"`
+}
+
+//服务发现缓存是否新鲜：有监控查询失败时为warn，此时返回的是之前的缓存数据，
+//连续失败超过maxStale时为fail，maxStale不大于0时只报告warn
+func Watches(lister discover.WatchLister, maxStale time.Duration) Checker {
+	return CheckerFunc(func(ctx context.Context) Result {
+		watches := lister.Watches()
+		var stale []staleWatch
+		status := StatusPass
+		for _, w := range watches {
+			if w.Error == "" {
+				continue
+			}
+			stale = append(stale, staleWatch{
+				ServiceName:  w.ServiceName,
+				Datacenter:   w.Datacenter,
+				Error:        w.Error,
+				FailingSince: w.FailingSince,
+			})
+			if maxStale > 0 && !w.FailingSince.IsZero() && time.Since(w.FailingSince) > maxStale {
+				status = StatusFail
+			} else if status == StatusPass {
+				status = StatusWarn
+			}
+		}
+		if len(stale) == 0 {
+			return Pass(strconv.Itoa(len(watches)) + " watch(es) up to date")
+		}
+		return Result{Status: status, Details: stale}
+	})
+}
+
+//下游服务是否有可用实例，opts为查询条件，如标签和数据中心
+func Service(client discover.Client, serviceName string, opts ...discover.QueryOption) Checker {
+	return CheckerFunc(func(ctx context.Context) Result {
+		instances, err := client.DiscoverService(ctx, serviceName, opts...)
+		if errors.Is(err, discover.ErrServiceNotFound) || (err == nil && len(instances) == 0) {
+			return Fail("no available instance of " + serviceName)
+		}
+		if err != nil {
+			return Fail(err.Error())
+		}
+		return Pass(strconv.Itoa(len(instances)) + " instance(s) available")
+	})
+}
+
+//本实例的注册状态：注册中或维护模式时为warn，注册信息无效或已注销时为fail
+func Registration(registrar *discover.Registrar) Checker {
+	return CheckerFunc(func(ctx context.Context) Result {
+		status := registrar.Status()
+		switch status.State {
+		case discover.RegistrationRegistered:
+			return Pass(status)
+		case discover.RegistrationPending, discover.RegistrationMaintenance:
+			return Warn(status)
+		default:
+			return Fail(status)
+		}
+	})
+}
+
+//由启动和退出流程显式打开、关闭的检查，关闭时为fail，
+//用于在监听建立之前和开始退出之后保持未就绪
+type Gate struct {
+	mutex  sync.RWMutex
+	open   bool
+	reason string
+}
+
+//创建关闭状态的Gate，reason为关闭时返回的原因
+func NewGate(reason string) *Gate {
+	return &Gate{reason: reason}
+}
+
+func (g *Gate) Open() {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.open, g.reason = true, ""
+}
+
+func (g *Gate) Close(reason string) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.open, g.reason = false, reason
+}
+
+func (g *Gate) Check(ctx context.Context) Result {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+	if !g.open {
+		return Fail(g.reason)
+	}
+	return Pass("open")
+}
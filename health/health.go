@@ -0,0 +1,228 @@
+package health
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+//可插拔的健康检查：各个组件以名字注册检查，Check并发执行全部检查并汇总为一个报告。
+//任意关键组件为fail时整体为fail，否则有组件为warn或非关键组件为fail时整体为warn
+
+//组件的健康状态
+type Status string
+
+const (
+	StatusPass Status = "pass" //正常
+	StatusWarn Status = "warn" //可以继续提供服务，但存在问题，如使用的是过期的缓存数据
+	StatusFail Status = "fail" //无法正常提供服务
+)
+
+//单次检查的默认超时时间
+const DefaultTimeout = 2 * time.Second
+
+//状态的严重程度，用于取最差的状态
+func (s Status) severity() int {
+	switch s {
+	case StatusPass:
+		return 0
+	case StatusWarn:
+		return 1
+	default:
+		return 2
+	}
+}
+
+//单个组件的检查结果
+type Result struct {
+	Status  Status
+	Details interface{} //检查的详细信息，如错误信息或组件的状态，需要可以序列化为json
+}
+
+func Pass(details interface{}) Result {
+	return Result{Status: StatusPass, Details: details}
+}
+
+func Warn(details interface{}) Result {
+	return Result{Status: StatusWarn, Details: details}
+}
+
+func Fail(details interface{}) Result {
+	return Result{Status: StatusFail, Details: details}
+}
+
+//组件的健康检查，需要在ctx结束时尽快返回
+type Checker interface {
+	Check(ctx context.Context) Result
+}
+
+//将函数适配为Checker
+type CheckerFunc func(ctx context.Context) Result
+
+func (f CheckerFunc) Check(ctx context.Context) Result {
+	return f(ctx)
+}
+
+//单个组件在报告中的结果
+type ComponentReport struct {
+	Name     string      `json:"name"`
+	Status   Status      `json:"status"`
+	Critical bool        `json:"critical"` //为false时fail只会使整体状态降级为warn
+	Details  interface{} `json:"details,omitempty"`
+	Duration string      `json:"duration"` //检查耗时
+}
+
+//汇总的健康报告
+type Report struct {
+	Status     Status            `json:"status"`
+	Components []ComponentReport `json:"components"`
+	CheckedAt  time.Time         `json:"checked_at"`
+}
+
+//整体状态不为fail时认为服务可用
+func (r Report) Healthy() bool {
+	return r.Status != StatusFail
+}
+
+//报告对应的http状态码，fail时返回503，使负载均衡和consul的HTTP检查摘除该实例
+func (r Report) HTTPStatus() int {
+	if r.Healthy() {
+		return http.StatusOK
+	}
+	return http.StatusServiceUnavailable
+}
+
+type component struct {
+	name     string
+	checker  Checker
+	critical bool
+}
+
+type RegisterOption func(*component)
+
+//非关键组件，检查失败时整体状态只降级为warn，如可选的下游服务
+func NonCritical() RegisterOption {
+	return func(c *component) {
+		c.critical = false
+	}
+}
+
+//服务的存活和就绪检查
+type Checks struct {
+	//进程是否存活，失败时应重启实例，不应包含依赖组件的检查，避免依赖故障导致全部实例被重启
+	Liveness *Registry
+	//实例是否可以接收流量，包含监听状态和依赖组件的检查，consul的注册检查指向它
+	Readiness *Registry
+}
+
+type Registry struct {
+	timeout time.Duration
+
+	mutex      sync.RWMutex
+	components []*component
+}
+
+//创建检查注册表，timeout为单次检查的超时时间，不大于0时使用DefaultTimeout
+func NewRegistry(timeout time.Duration) *Registry {
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	return &Registry{timeout: timeout}
+}
+
+//注册组件的检查，同名的检查会被替换，可以在运行时调用
+func (r *Registry) Register(name string, checker Checker, opts ...RegisterOption) {
+	c := &component{name: name, checker: checker, critical: true}
+	for _, opt := range opts {
+		opt(c)
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for i, existing := range r.components {
+		if existing.name == name {
+			r.components[i] = c
+			return
+		}
+	}
+	r.components = append(r.components, c)
+}
+
+//取消组件的检查
+func (r *Registry) Unregister(name string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for i, existing := range r.components {
+		if existing.name == name {
+			r.components = append(r.components[:i], r.components[i+1:]...)
+			return
+		}
+	}
+}
+
+//并发执行全部检查，超时的检查视为fail。没有注册任何检查或r为nil时为pass
+func (r *Registry) Check(ctx context.Context) Report {
+	if r == nil {
+		return Report{Status: StatusPass, Components: []ComponentReport{}, CheckedAt: time.Now()}
+	}
+	r.mutex.RLock()
+	components := append([]*component(nil), r.components...)
+	r.mutex.RUnlock()
+
+	report := Report{
+		Status:     StatusPass,
+		Components: make([]ComponentReport, len(components)),
+		CheckedAt:  time.Now(),
+	}
+	var wg sync.WaitGroup
+	for i, c := range components {
+		wg.Add(1)
+		go func(i int, c *component) {
+			defer wg.Done()
+			report.Components[i] = r.check(ctx, c)
+		}(i, c)
+	}
+	wg.Wait()
+
+	for _, c := range report.Components {
+		status := c.Status
+		if status == StatusFail && !c.Critical {
+			status = StatusWarn
+		}
+		if status.severity() > report.Status.severity() {
+			report.Status = status
+		}
+	}
+	sort.SliceStable(report.Components, func(i, j int) bool {
+		return report.Components[i].Name < report.Components[j].Name
+	})
+	return report
+}
+
+//在超时时间内执行单个检查，检查没有及时返回时不再等待
+func (r *Registry) check(ctx context.Context, c *component) ComponentReport {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+	start := time.Now()
+	results := make(chan Result, 1)
+	go func() {
+		results <- c.checker.Check(ctx)
+	}()
+	var result Result
+	select {
+	case result = <-results:
+	case <-ctx.Done():
+		result = Fail("check timed out: " + ctx.Err().Error())
+	}
+	if result.Status == "" {
+		result.Status = StatusPass
+	}
+	return ComponentReport{
+		Name:     c.name,
+		Status:   result.Status,
+		Critical: c.critical,
+		Details:  result.Details,
+		Duration: time.Since(start).Round(time.Microsecond).String(),
+	}
+}
@@ -0,0 +1,321 @@
+package kvconfig
+
+import (
+	"context"
+	"fmt"
+	"github.com/hashicorp/consul/api"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//基于consul KV的动态配置：从prefix下加载所有配置项，并使用阻塞查询监控变化，
+//配置项发生变化时调用注册的回调。配置项的key为去掉prefix后的部分，如prefix为config/string/时，
+//config/string/str_max_size对应的key为str_max_size
+
+const (
+	//阻塞查询的最长等待时间
+	defaultWaitTime = 5 * time.Minute
+	//查询失败后的重试间隔，每次失败翻倍
+	retryMin = time.Second
+	retryMax = time.Minute
+)
+
+type Provider struct {
+	kv     *api.KV
+	prefix string
+	logger *log.Logger
+
+	mutex sync.Mutex
+	//当前的配置项
+	values map[string]string
+	//上一次查询返回的X-Consul-Index
+	index uint64
+	//按key注册的回调
+	callbacks map[string][]func(value string, ok bool)
+
+	watchOnce sync.Once
+	closeOnce sync.Once
+	stop      chan struct{}
+	done      chan struct{}
+}
+
+//创建配置，config通常由consulapi.NewConsulConfig创建，logger为nil时使用标准库默认的logger
+func NewProvider(config *api.Config, prefix string, logger *log.Logger) (*Provider, error) {
+	client, err := api.NewClient(config)
+	if err != nil {
+		return nil, err
+	}
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	if logger == nil {
+		logger = log.New(os.Stderr, "", log.LstdFlags)
+	}
+	return &Provider{
+		kv:        client.KV(),
+		prefix:    prefix,
+		logger:    logger,
+		values:    make(map[string]string),
+		callbacks: make(map[string][]func(value string, ok bool)),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}, nil
+}
+
+//同步加载一次所有配置项，通常在启动时调用，失败时保留当前的配置
+func (p *Provider) Load(ctx context.Context) error {
+	pairs, meta, err := p.kv.List(p.prefix, (&api.QueryOptions{}).WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("load config from %s: %w", p.prefix, err)
+	}
+	p.update(pairs, meta.LastIndex)
+	return nil
+}
+
+//在后台使用阻塞查询监控配置变化，直到调用Close，多次调用只启动一次
+func (p *Provider) Watch() {
+	p.watchOnce.Do(func() {
+		go p.watch()
+	})
+}
+
+//停止监控，停止后不会再调用回调
+func (p *Provider) Close() error {
+	p.closeOnce.Do(func() {
+		close(p.stop)
+	})
+	started := true
+	p.watchOnce.Do(func() {
+		started = false
+	})
+	if started {
+		<-p.done
+	}
+	return nil
+}
+
+//配置项的当前值
+func (p *Provider) Get(key string) (string, bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	value, ok := p.values[key]
+	return value, ok
+}
+
+//所有配置项的副本
+func (p *Provider) Values() map[string]string {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	values := make(map[string]string, len(p.values))
+	for key, value := range p.values {
+		values[key] = value
+	}
+	return values
+}
+
+//配置项不存在时返回def
+func (p *Provider) String(key, def string) string {
+	if value, ok := p.Get(key); ok {
+		return value
+	}
+	return def
+}
+
+//配置项不存在或不是整数时返回def
+func (p *Provider) Int(key string, def int) int {
+	if value, ok := p.Get(key); ok {
+		if i, err := strconv.Atoi(strings.TrimSpace(value)); err == nil {
+			return i
+		}
+	}
+	return def
+}
+
+//配置项不存在或不是布尔值时返回def
+func (p *Provider) Bool(key string, def bool) bool {
+	if value, ok := p.Get(key); ok {
+		if b, err := strconv.ParseBool(strings.TrimSpace(value)); err == nil {
+			return b
+		}
+	}
+	return def
+}
+
+//配置项不存在或不是时间间隔（如10s）时返回def
+func (p *Provider) Duration(key string, def time.Duration) time.Duration {
+	if value, ok := p.Get(key); ok {
+		if d, err := time.ParseDuration(strings.TrimSpace(value)); err == nil {
+			return d
+		}
+	}
+	return def
+}
+
+//注册配置项变化的回调，配置项被删除时ok为false。回调在监控的goroutine中依次执行，不应阻塞
+func (p *Provider) OnChange(key string, fn func(value string, ok bool)) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.callbacks[key] = append(p.callbacks[key], fn)
+}
+
+//绑定字符串配置项：立即使用当前值调用一次fn，之后每次变化时调用，配置项不存在时使用def
+func (p *Provider) BindString(key, def string, fn func(string)) {
+	p.bind(key, func(value string, ok bool) {
+		if !ok {
+			value = def
+		}
+		fn(value)
+	})
+}
+
+//绑定整数配置项，配置项不存在时使用def，无法解析的值会被记录并忽略
+func (p *Provider) BindInt(key string, def int, fn func(int)) {
+	p.bind(key, func(value string, ok bool) {
+		if !ok {
+			fn(def)
+			return
+		}
+		i, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil {
+			p.logger.Printf("config %s%s: invalid int %q, ignored", p.prefix, key, value)
+			return
+		}
+		fn(i)
+	})
+}
+
+//绑定布尔配置项，配置项不存在时使用def，无法解析的值会被记录并忽略
+func (p *Provider) BindBool(key string, def bool, fn func(bool)) {
+	p.bind(key, func(value string, ok bool) {
+		if !ok {
+			fn(def)
+			return
+		}
+		b, err := strconv.ParseBool(strings.TrimSpace(value))
+		if err != nil {
+			p.logger.Printf("config %s%s: invalid bool %q, ignored", p.prefix, key, value)
+			return
+		}
+		fn(b)
+	})
+}
+
+//绑定时间间隔配置项，配置项不存在时使用def，无法解析的值会被记录并忽略
+func (p *Provider) BindDuration(key string, def time.Duration, fn func(time.Duration)) {
+	p.bind(key, func(value string, ok bool) {
+		if !ok {
+			fn(def)
+			return
+		}
+		d, err := time.ParseDuration(strings.TrimSpace(value))
+		if err != nil {
+			p.logger.Printf("config %s%s: invalid duration %q, ignored", p.prefix, key, value)
+			return
+		}
+		fn(d)
+	})
+}
+
+//注册回调并使用当前值调用一次
+func (p *Provider) bind(key string, fn func(value string, ok bool)) {
+	p.OnChange(key, fn)
+	value, ok := p.Get(key)
+	fn(value, ok)
+}
+
+//阻塞查询prefix下的配置项，失败时退避重试
+func (p *Provider) watch() {
+	defer close(p.done)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-p.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	retry := retryMin
+	for {
+		p.mutex.Lock()
+		index := p.index
+		p.mutex.Unlock()
+		queryOptions := &api.QueryOptions{WaitIndex: index, WaitTime: defaultWaitTime}
+		pairs, meta, err := p.kv.List(p.prefix, queryOptions.WithContext(ctx))
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			p.logger.Printf("watch config %s failed: %v, retry in %s", p.prefix, err, retry)
+			select {
+			case <-time.After(retry):
+			case <-ctx.Done():
+				return
+			}
+			if retry *= 2; retry > retryMax {
+				retry = retryMax
+			}
+			continue
+		}
+		retry = retryMin
+		p.update(pairs, meta.LastIndex)
+	}
+}
+
+//替换当前配置并调用发生变化的配置项的回调
+func (p *Provider) update(pairs api.KVPairs, index uint64) {
+	values := make(map[string]string, len(pairs))
+	for _, pair := range pairs {
+		key := strings.TrimPrefix(pair.Key, p.prefix)
+		//忽略目录
+		if key == "" || strings.HasSuffix(key, "/") {
+			continue
+		}
+		values[key] = string(pair.Value)
+	}
+
+	type change struct {
+		key   string
+		value string
+		ok    bool
+	}
+	p.mutex.Lock()
+	//index变小说明consul的数据被重置，需要从头开始查询
+	if index < p.index {
+		index = 0
+	}
+	p.index = index
+	var changes []change
+	for key, value := range values {
+		if old, ok := p.values[key]; !ok || old != value {
+			changes = append(changes, change{key, value, true})
+		}
+	}
+	for key := range p.values {
+		if _, ok := values[key]; !ok {
+			changes = append(changes, change{key: key})
+		}
+	}
+	p.values = values
+	callbacks := make([][]func(string, bool), len(changes))
+	for i, c := range changes {
+		callbacks[i] = append([]func(string, bool){}, p.callbacks[c.key]...)
+	}
+	p.mutex.Unlock()
+
+	for i, c := range changes {
+		if c.ok {
+			p.logger.Printf("config %s%s changed to %q", p.prefix, c.key, c.value)
+		} else {
+			p.logger.Printf("config %s%s removed", p.prefix, c.key)
+		}
+		for _, fn := range callbacks[i] {
+			fn(c.value, c.ok)
+		}
+	}
+}
@@ -0,0 +1,349 @@
+package leader
+
+import (
+	"context"
+	"errors"
+	"github.com/hashicorp/consul/api"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+//基于consul session和KV锁的选主：同一个服务的实例竞争同一个key，
+//持有该key的session所属的实例为leader，key的值为leader的实例ID。
+//session失效（实例崩溃、与consul失联超过TTL）时consul会释放锁，其他实例随后获得leader
+
+var ErrNoLeader = errors.New("no leader elected")
+
+const (
+	//session的默认TTL，实例崩溃后最长经过2倍TTL锁才会被释放
+	defaultSessionTTL = 15 * time.Second
+	//session失效后锁的保护时间，期间其他实例无法获取锁
+	defaultLockDelay = 5 * time.Second
+	//请求失败后的重试间隔，每次失败翻倍
+	retryMin = time.Second
+	retryMax = time.Minute
+	//关闭时等待session销毁的最长时间
+	releaseTimeout = 5 * time.Second
+)
+
+//服务的leader在KV中的key
+func Key(serviceName string) string {
+	return "service/" + serviceName + "/leader"
+}
+
+type Elector struct {
+	client     *api.Client
+	key        string
+	instanceId string
+	sessionTTL time.Duration
+	logger     *log.Logger
+
+	mutex sync.Mutex
+	//最近观察到的leader的实例ID
+	leader   string
+	isLeader bool
+	elected  []func(ctx context.Context)
+	revoked  []func()
+	//取消当前任期的ctx
+	cancelTerm context.CancelFunc
+
+	runOnce   sync.Once
+	closeOnce sync.Once
+	stop      chan struct{}
+	done      chan struct{}
+}
+
+type Option func(*Elector)
+
+//使用指定的key竞争leader，默认为Key(serviceName)
+func WithKey(key string) Option {
+	return func(e *Elector) {
+		e.key = key
+	}
+}
+
+//session的TTL，consul要求在10s到24h之间
+func WithSessionTTL(ttl time.Duration) Option {
+	return func(e *Elector) {
+		e.sessionTTL = ttl
+	}
+}
+
+//创建选主，config通常由consulapi.NewConsulConfig创建，logger为nil时使用标准库默认的logger
+func NewElector(config *api.Config, serviceName, instanceId string, logger *log.Logger, opts ...Option) (*Elector, error) {
+	client, err := api.NewClient(config)
+	if err != nil {
+		return nil, err
+	}
+	if logger == nil {
+		logger = log.New(os.Stderr, "", log.LstdFlags)
+	}
+	e := &Elector{
+		client:     client,
+		key:        Key(serviceName),
+		instanceId: instanceId,
+		sessionTTL: defaultSessionTTL,
+		logger:     logger,
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(e)
+	}
+	return e, nil
+}
+
+//成为leader时在新的goroutine中调用fn，失去leader或关闭时ctx被取消。需要在Run之前注册
+func (e *Elector) OnElected(fn func(ctx context.Context)) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.elected = append(e.elected, fn)
+}
+
+//失去leader时调用fn，需要在Run之前注册
+func (e *Elector) OnRevoked(fn func()) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.revoked = append(e.revoked, fn)
+}
+
+//在后台参与选主，直到调用Close，多次调用只启动一次
+func (e *Elector) Run() {
+	e.runOnce.Do(func() {
+		go e.run()
+	})
+}
+
+//当前实例是否为leader
+func (e *Elector) IsLeader() bool {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return e.isLeader
+}
+
+//最近观察到的leader的实例ID，没有leader时返回ErrNoLeader
+func (e *Elector) Leader() (string, error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.leader == "" {
+		return "", ErrNoLeader
+	}
+	return e.leader, nil
+}
+
+//退出选主，是leader时先取消任期再释放锁
+func (e *Elector) Close() error {
+	e.closeOnce.Do(func() {
+		close(e.stop)
+	})
+	started := true
+	e.runOnce.Do(func() {
+		started = false
+	})
+	if started {
+		<-e.done
+	}
+	return nil
+}
+
+func (e *Elector) run() {
+	defer close(e.done)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-e.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	var (
+		session   string
+		renewDone chan struct{}
+		renewErr  chan error
+		index     uint64
+		//最近一次确认当前实例持有锁的时间
+		confirmed time.Time
+	)
+	retry := retryMin
+	//session已经失效，锁也随之释放，重新创建session参与选主
+	sessionLost := func(err error) {
+		e.logger.Printf("session for %s lost: %v", e.key, err)
+		session = ""
+		e.setLeader("", false)
+	}
+	//等待重试，ctx被取消时返回false。等待期间session失效时立即返回；是leader时，
+	//超过session TTL没有确认仍持有锁就退出leader，此时锁可能已经被consul释放并由其他实例获得
+	wait := func(d time.Duration) bool {
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		var expired <-chan time.Time
+		if e.IsLeader() {
+			deadline := time.NewTimer(time.Until(confirmed.Add(e.sessionTTL)))
+			defer deadline.Stop()
+			expired = deadline.C
+		}
+		for {
+			select {
+			case <-timer.C:
+				return true
+			case <-ctx.Done():
+				return false
+			case err := <-renewErr:
+				sessionLost(err)
+				return true
+			case <-expired:
+				e.logger.Printf("leadership of %s not confirmed within %s, stepping down", e.key, e.sessionTTL)
+				e.setLeader("", false)
+				expired = nil
+			}
+		}
+	}
+	backoff := func(format string, args ...interface{}) bool {
+		e.logger.Printf(format+", retry in %s", append(args, retry)...)
+		ok := wait(retry)
+		if retry *= 2; retry > retryMax {
+			retry = retryMax
+		}
+		return ok
+	}
+	defer func() {
+		e.setLeader("", false)
+		if session == "" {
+			return
+		}
+		//关闭renewDone后RenewPeriodic会销毁session，锁随之释放
+		close(renewDone)
+		select {
+		case <-renewErr:
+		case <-time.After(releaseTimeout):
+			e.logger.Printf("release leader lock %s timed out", e.key)
+		}
+	}()
+
+	for ctx.Err() == nil {
+		if session == "" {
+			id, _, err := e.client.Session().Create(&api.SessionEntry{
+				Name:      e.key + "/" + e.instanceId,
+				TTL:       e.sessionTTL.String(),
+				LockDelay: defaultLockDelay,
+				Behavior:  api.SessionBehaviorRelease,
+			}, (&api.WriteOptions{}).WithContext(ctx))
+			if err != nil {
+				if ctx.Err() != nil || !backoff("create session for %s failed: %v", e.key, err) {
+					return
+				}
+				continue
+			}
+			session, index = id, 0
+			renewDone, renewErr = make(chan struct{}), make(chan error, 1)
+			go func(id string, done chan struct{}, errc chan error) {
+				errc <- e.client.Session().RenewPeriodic(e.sessionTTL.String(), id, nil, done)
+			}(session, renewDone, renewErr)
+		}
+		select {
+		case err := <-renewErr:
+			sessionLost(err)
+			continue
+		default:
+		}
+
+		//阻塞查询的等待时间不超过TTL，保证能及时发现session失效；
+		//是leader时必须在上次确认后的TTL内得到结果，否则视为无法确认，由wait退出leader
+		queryOptions := &api.QueryOptions{WaitIndex: index, WaitTime: e.sessionTTL}
+		getCtx, cancelGet := ctx, context.CancelFunc(func() {})
+		if e.IsLeader() {
+			queryOptions.WaitTime = e.sessionTTL / 2
+			getCtx, cancelGet = context.WithDeadline(ctx, confirmed.Add(e.sessionTTL))
+		}
+		pair, meta, err := e.client.KV().Get(e.key, queryOptions.WithContext(getCtx))
+		cancelGet()
+		if err != nil {
+			index = 0
+			if ctx.Err() != nil || !backoff("watch leader %s failed: %v", e.key, err) {
+				return
+			}
+			continue
+		}
+		index = meta.LastIndex
+		if pair != nil && pair.Session != "" {
+			if pair.Session == session {
+				confirmed = time.Now()
+			}
+			e.setLeader(string(pair.Value), pair.Session == session)
+			retry = retryMin
+			continue
+		}
+
+		//锁空闲，之前是leader时说明锁已经丢失，尝试获取
+		e.setLeader("", false)
+		acquired, _, err := e.client.KV().Acquire(&api.KVPair{
+			Key:     e.key,
+			Value:   []byte(e.instanceId),
+			Session: session,
+		}, (&api.WriteOptions{}).WithContext(ctx))
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			//session可能已经失效，放弃它并在重试时创建新的session
+			close(renewDone)
+			session = ""
+			if !backoff("acquire leader %s failed: %v", e.key, err) {
+				return
+			}
+			continue
+		}
+		retry = retryMin
+		if acquired {
+			confirmed = time.Now()
+			e.setLeader(e.instanceId, true)
+			continue
+		}
+		//锁处于lock-delay保护期，稍后重试
+		index = 0
+		if !wait(defaultLockDelay) {
+			return
+		}
+	}
+}
+
+//更新leader，当前实例的leader状态变化时调用回调
+func (e *Elector) setLeader(leader string, isLeader bool) {
+	e.mutex.Lock()
+	e.leader = leader
+	if isLeader == e.isLeader {
+		e.mutex.Unlock()
+		return
+	}
+	e.isLeader = isLeader
+	var (
+		term    context.Context
+		elected []func(ctx context.Context)
+		revoked []func()
+	)
+	if isLeader {
+		term, e.cancelTerm = context.WithCancel(context.Background())
+		elected = append(elected, e.elected...)
+	} else {
+		e.cancelTerm()
+		e.cancelTerm = nil
+		revoked = append(revoked, e.revoked...)
+	}
+	e.mutex.Unlock()
+
+	if isLeader {
+		e.logger.Printf("instance %s became leader of %s", e.instanceId, e.key)
+	} else {
+		e.logger.Printf("instance %s is no longer leader of %s", e.instanceId, e.key)
+	}
+	for _, fn := range elected {
+		go fn(term)
+	}
+	for _, fn := range revoked {
+		fn()
+	}
+}
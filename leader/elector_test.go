@@ -0,0 +1,100 @@
+package leader_test
+
+import (
+	"gomicro-discover/discover/consulapi"
+	"gomicro-discover/discover/discovertest"
+	"gomicro-discover/leader"
+	"io/ioutil"
+	"log"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+//fake consul不校验session TTL，使用较短的TTL加快测试
+const testSessionTTL = 300 * time.Millisecond
+
+func newElector(t *testing.T, server *discovertest.ConsulServer, instanceId string) *leader.Elector {
+	t.Helper()
+	config, err := consulapi.NewConsulConfig(server.Host(), server.Port())
+	if err != nil {
+		t.Fatal(err)
+	}
+	elector, err := leader.NewElector(config, "string", instanceId, log.New(ioutil.Discard, "", 0), leader.WithSessionTTL(testSessionTTL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return elector
+}
+
+//等待cond成立，超时后测试失败
+func eventually(t *testing.T, timeout time.Duration, message string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", message)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+//consul不可达时leader无法确认仍持有锁，session TTL内必须退出leader，
+//否则consul释放锁后其他实例成为leader，出现两个leader
+func TestElectorStepsDownWhenConsulUnreachable(t *testing.T) {
+	server := discovertest.NewConsulServer()
+	defer server.Close()
+	elector := newElector(t, server, "string-1")
+	var revoked int32
+	elector.OnRevoked(func() { atomic.AddInt32(&revoked, 1) })
+	elector.Run()
+	defer elector.Close()
+	eventually(t, 5*time.Second, "election", elector.IsLeader)
+
+	server.FailRequests(500)
+	start := time.Now()
+	eventually(t, 5*time.Second, "step down", func() bool { return !elector.IsLeader() })
+	//退出的时间不应明显超过session TTL，而不是等待最长1分钟的退避
+	if took := time.Since(start); took > 3*testSessionTTL {
+		t.Fatalf("stepped down after %s, want within about %s", took, testSessionTTL)
+	}
+	if atomic.LoadInt32(&revoked) != 1 {
+		t.Fatalf("OnRevoked called %d times, want 1", revoked)
+	}
+	if _, err := elector.Leader(); err != leader.ErrNoLeader {
+		t.Fatalf("Leader() err = %v, want ErrNoLeader", err)
+	}
+
+	//consul恢复后重新当选
+	server.FailRequests(0)
+	eventually(t, 5*time.Second, "re-election", elector.IsLeader)
+}
+
+//session失效时锁被释放，旧leader退出，由其他实例接任
+func TestElectorStepsDownWhenSessionDestroyed(t *testing.T) {
+	server := discovertest.NewConsulServer()
+	defer server.Close()
+	first := newElector(t, server, "string-1")
+	first.Run()
+	defer first.Close()
+	eventually(t, 5*time.Second, "election", first.IsLeader)
+
+	second := newElector(t, server, "string-2")
+	second.Run()
+	defer second.Close()
+	eventually(t, 5*time.Second, "second instance to observe the leader", func() bool {
+		id, err := second.Leader()
+		return err == nil && id == "string-1"
+	})
+	if second.IsLeader() {
+		t.Fatal("two leaders elected")
+	}
+
+	server.DestroySession(server.LockSession(leader.Key("string")))
+	eventually(t, 10*time.Second, "leadership to move", func() bool {
+		return second.IsLeader() && !first.IsLeader()
+	})
+	if id, err := first.Leader(); err != nil || id != "string-2" {
+		t.Fatalf("old leader observes %q, %v, want string-2", id, err)
+	}
+}
@@ -0,0 +1,33 @@
+package leader
+
+import (
+	"context"
+	"fmt"
+	"github.com/hashicorp/consul/api"
+)
+
+//查询任意服务当前的leader，不参与选主
+type Resolver struct {
+	kv *api.KV
+}
+
+func NewResolver(config *api.Config) (*Resolver, error) {
+	client, err := api.NewClient(config)
+	if err != nil {
+		return nil, err
+	}
+	return &Resolver{kv: client.KV()}, nil
+}
+
+//服务当前leader的实例ID，没有leader时返回ErrNoLeader
+func (r *Resolver) Leader(ctx context.Context, serviceName string) (string, error) {
+	pair, _, err := r.kv.Get(Key(serviceName), (&api.QueryOptions{}).WithContext(ctx))
+	if err != nil {
+		return "", fmt.Errorf("lookup leader of %s: %w", serviceName, err)
+	}
+	//key存在但没有session持有时说明leader已经退出
+	if pair == nil || pair.Session == "" {
+		return "", ErrNoLeader
+	}
+	return string(pair.Value), nil
+}
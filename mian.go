@@ -4,78 +4,258 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	kitlog "github.com/go-kit/kit/log"
+	kitprometheus "github.com/go-kit/kit/metrics/prometheus"
+	stdprometheus "github.com/prometheus/client_golang/prometheus"
 	uuid "github.com/satori/go.uuid"
 	"gomicro-discover/config"
 	"gomicro-discover/discover"
+	"gomicro-discover/discover/consulapi"
+	"gomicro-discover/discover/discovermetrics"
+	"gomicro-discover/discover/discovertracing"
 	"gomicro-discover/endpoint"
+	"gomicro-discover/health"
+	"gomicro-discover/kvconfig"
+	"gomicro-discover/leader"
+	"gomicro-discover/plugins"
 	"gomicro-discover/service"
+	"gomicro-discover/shutdown"
+	"gomicro-discover/tracing"
 	"gomicro-discover/transport"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"strconv"
 	"syscall"
+	"time"
 )
 
 //从命令行中读取相关参数，没有时，使用默认值
 
 func main() {
+	//consul地址、ACL token、https以及服务发现的快照和一致性模式
+	consulFlags := discover.RegisterClientFlags(flag.CommandLine)
 	var (
 		//服务地址、端口、服务名
 		servicePort = flag.Int("service.port", 10086, "service port")
 		serviceHost = flag.String("service.host", "127.0.0.1", "service host")
 		serviceName = flag.String("service.name", "SayHello", "service name")
 
-		//consul 地址
-		consulPort = flag.Int("consul.port", 8500, "consul port")
-		consulHost = flag.String("consul.host", "127.0.0.1", "consul host")
+		//服务实例标签，多个标签使用逗号分隔
+		serviceTags = flag.String("service.tags", "", "comma separated service tags")
+
+		//TTL心跳检查，为0时使用consul主动发起的HTTP检查
+		checkTTL = flag.Duration("check.ttl", 0, "register a TTL heartbeat check with this ttl instead of an HTTP check")
+		//健康检查配置文件，与-check指定的检查合并，指定了任何检查时忽略-check.ttl和默认的HTTP检查
+		checkConfig = flag.String("check.config", "", "json file declaring the health checks of this instance")
+
+		//动态配置在consul KV中的目录，为空时使用config/<service.name>/
+		configPrefix = flag.String("config.prefix", "", "consul kv prefix holding the dynamic config")
+
+		//退出时进入维护模式后等待调用方感知的时间，以及等待处理中的请求完成的最长时间
+		shutdownDelay   = flag.Duration("shutdown.delay", shutdown.DefaultPropagationDelay, "time to wait after entering maintenance mode before deregistering")
+		shutdownTimeout = flag.Duration("shutdown.timeout", shutdown.DefaultDrainTimeout, "deadline for in-flight requests to finish on shutdown")
+
+		//服务发现缓存命中情况按服务名记录的服务，-health.require中的服务总是记录，其他服务记录为other
+		discoveryMetricsServices = flag.String("discovery.metrics-services", "", "comma separated services whose discovery cache hits and misses are labelled by name, others are counted as other")
+
+		//健康检查：单次检查的超时时间、必须可用的下游服务、服务发现缓存允许的最长失败时间
+		healthTimeout  = flag.Duration("health.timeout", health.DefaultTimeout, "timeout of each dependency check behind /health")
+		healthRequire  = flag.String("health.require", "", "comma separated downstream services that must have available instances")
+		healthMaxStale = flag.Duration("health.max-stale", time.Minute, "fail /health once the discovery cache has been failing to refresh for this long")
+
+		//分布式追踪：没有上游追踪上下文时的采样比例，上游已采样的请求始终采样；是否将span写入日志
+		tracingSampleRate = flag.Float64("tracing.sample-rate", 0, "fraction of requests without an upstream trace context to sample, sampled upstream traces are always followed")
+		tracingLog        = flag.Bool("tracing.log", false, "log finished spans")
+
+		//是否参与本服务实例之间的选主
+		leaderElect = flag.Bool("leader.elect", false, "take part in leader election among the instances of this service")
 	)
+	//可以重复指定的健康检查，如 -check http=/health/ready,interval=10s -check tcp=self,interval=10s
+	var checks discover.CheckDefinitions
+	flag.Var(&checks, "check", "health check spec, may be repeated (e.g. http=/health/ready,interval=10s,timeout=2s)")
 	flag.Parse()
+	var spanLogger kitlog.Logger
+	if *tracingLog {
+		spanLogger = config.KitLogger
+	}
+	tracing.Init(*tracingSampleRate, spanLogger)
+	if *checkConfig != "" {
+		fileChecks, err := discover.LoadCheckDefinitions(*checkConfig)
+		if err != nil {
+			config.Logger.Printf("load health checks failed: %v", err)
+			os.Exit(-1)
+		}
+		checks = append(checks, fileChecks...)
+	}
 	ctx := context.Background()
-	errChan := make(chan error)
+	//信号和server退出都会写入，退出过程中不再读取
+	errChan := make(chan error, 2)
 
 	//生命服务发现客户端
-	var discoverClient discover.DiscoveryClient
+	var discoverClient discover.Client
 
-	discoverClient, err := discover.NewKitDiscoverClient(*consulHost, *consulPort)
+	consulOptions, err := consulFlags.Options()
+	if err != nil {
+		config.Logger.Println(err)
+		os.Exit(-1)
+	}
+	discoverClient, err = consulapi.NewKitDiscoverClient(consulFlags.Host, consulFlags.Port, consulOptions...)
 
 	//获取服务发现客户端失败，直接关闭服务
 	if err != nil {
 		config.Logger.Println("Get consul Client failed")
 		os.Exit(-1)
 	}
+	//每次服务发现客户端的调用作为请求span的子span
+	discoverClient = discovertracing.NewClient(discoverClient)
+	//记录服务发现客户端的prometheus指标，通过/metrics暴露
+	metricsServices := append(discover.ParseTags(*discoveryMetricsServices), discover.ParseTags(*healthRequire)...)
+	discoverClient, err = discovermetrics.NewClient(discoverClient, nil, discovermetrics.WithServices(metricsServices...))
+	if err != nil {
+		config.Logger.Printf("register discovery metrics failed: %v", err)
+		os.Exit(-1)
+	}
+
+	//访问KV等服务发现之外的consul接口使用的配置
+	consulConfig, err := consulapi.NewConsulConfig(consulFlags.Host, consulFlags.Port, consulOptions...)
+	if err != nil {
+		config.Logger.Printf("create consul config failed: %v", err)
+		os.Exit(-1)
+	}
+	leaders, err := leader.NewResolver(consulConfig)
+	if err != nil {
+		config.Logger.Printf("create leader resolver failed: %v", err)
+		os.Exit(-1)
+	}
+
+	//就绪检查包含监听状态和依赖组件，/health/ready返回汇总的报告，consul检查和TTL心跳也据此上报状态；
+	//存活检查不包含依赖，依赖故障时不应重启实例
+	readiness := health.NewRegistry(*healthTimeout)
+	healthChecks := health.Checks{
+		Liveness:  health.NewRegistry(*healthTimeout),
+		Readiness: readiness,
+	}
+	//http监听建立之后才就绪，开始退出时重新关闭
+	listening := health.NewGate("http listener not bound yet")
+	readiness.Register("listener", listening)
+	if pinger, ok := discoverClient.(discover.Pinger); ok {
+		readiness.Register("consul", health.Consul(pinger))
+	}
+	if lister, ok := discoverClient.(discover.WatchLister); ok {
+		readiness.Register("discovery_cache", health.Watches(lister, *healthMaxStale))
+	}
+	for _, name := range discover.ParseTags(*healthRequire) {
+		readiness.Register("service:"+name, health.Service(discoverClient, name))
+	}
 
 	//声明并初始化service
-	var svc = service.NewDiscoverServiceImpl(discoverClient)
+	discoveryService := service.NewDiscoverServiceImpl(discoverClient, leaders, healthChecks)
+	var svc service.Service = discoveryService
+
+	//从consul KV加载动态配置，加载失败时先使用默认值，后台监控会继续重试
+	if *configPrefix == "" {
+		*configPrefix = "config/" + *serviceName + "/"
+	}
+	kvConfig, err := kvconfig.NewProvider(consulConfig, *configPrefix, config.Logger)
+	if err != nil {
+		config.Logger.Printf("create config provider failed: %v", err)
+		os.Exit(-1)
+	}
+	if err := kvConfig.Load(ctx); err != nil {
+		config.Logger.Printf("load config failed, using defaults: %v", err)
+	}
+	kvConfig.BindString(config.KeyGreeting, service.DefaultGreeting, discoveryService.SetGreeting)
+	kvConfig.Watch()
+
+	//service层的调用次数、错误次数和耗时，通过/metrics暴露
+	fieldKeys := []string{"method"}
+	svc = plugins.InstrumentingMiddleware(
+		kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: "discovery_service",
+			Name:      "requests_total",
+			Help:      "Number of service calls by method.",
+		}, fieldKeys),
+		kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: "discovery_service",
+			Name:      "errors_total",
+			Help:      "Number of failed service calls by method.",
+		}, fieldKeys),
+		kitprometheus.NewHistogramFrom(stdprometheus.HistogramOpts{
+			Namespace: "discovery_service",
+			Name:      "request_duration_seconds",
+			Help:      "Latency of service calls by method.",
+			Buckets:   stdprometheus.DefBuckets,
+		}, fieldKeys),
+	)(svc)
+
+	//定义服务实例id
+	instanceId := *serviceName + "-" + uuid.NewV4().String()
+	//服务注册信息，由registrar负责注册并保持注册
+	registrar := discover.NewRegistrar(discoverClient, &discover.Registration{
+		ServiceName:    *serviceName,
+		InstanceId:     instanceId,
+		InstanceHost:   *serviceHost,
+		InstancePort:   *servicePort,
+		HealthCheckUrl: "/health/ready",
+		Tags:           discover.ParseTags(*serviceTags),
+		TTL:            *checkTTL,
+		HealthCheck:    svc.HealthCheck,
+		Checks:         checks,
+	}, discover.WithRegistrarLogger(config.Logger))
+	readiness.Register("registration", health.Registration(registrar))
 
 	//创建endpoint
 	sayHellopoint := endpoint.MakeSayHelloEndpoint(svc)
 	discoveryEndpoint := endpoint.MakeDiscoveryEndpoint(svc)
+	leaderEndpoint := endpoint.MakeLeaderEndpoint(svc)
+	//业务endpoint作为http server span的子span
+	sayHellopoint = tracing.EndpointMiddleware("SayHello")(sayHellopoint)
+	discoveryEndpoint = tracing.EndpointMiddleware("Discovery")(discoveryEndpoint)
+	leaderEndpoint = tracing.EndpointMiddleware("Leader")(leaderEndpoint)
 	healthEndpoint := endpoint.MakeHealthCheckEndpoint(svc)
 
 	endpts := endpoint.DiscoveryEndpoint{
 		SayHelloEndpoint:    sayHellopoint,
 		DiscoveryEndpoint:   discoveryEndpoint,
+		LeaderEndpoint:      leaderEndpoint,
 		HealthCheckEndpoint: healthEndpoint,
 	}
 
 	//创建http.handler
-	r := transport.MakeHttpHandler(ctx, endpts, config.KitLogger)
-	//定义服务实例id
-	instanceId := *serviceName + "-" + uuid.NewV4().String()
+	r := transport.MakeHttpHandler(ctx, endpts, nil, config.KitLogger)
+
+	//参与本服务的选主，只应在一个实例上运行的任务通过OnElected启动
+	var elector *leader.Elector
+	if *leaderElect {
+		elector, err = leader.NewElector(consulConfig, *serviceName, instanceId, config.Logger)
+		if err != nil {
+			config.Logger.Printf("create leader elector failed: %v", err)
+			os.Exit(-1)
+		}
+		elector.Run()
+	}
+
+	server := &http.Server{
+		Addr:    ":" + strconv.Itoa(*servicePort),
+		Handler: r,
+	}
+
+	//先建立监听再注册，保证consul的检查和调用方的请求到达时已经可以处理
+	listener, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		config.Logger.Printf("listen on %s failed: %v", server.Addr, err)
+		os.Exit(-1)
+	}
+	listening.Open()
+	//在后台注册服务，失败时退避重试，注册丢失时自动重新注册
+	registrar.Start()
 
 	//启动httpserver
 	go func() {
 		config.Logger.Println("Http Server start at port:" + strconv.Itoa(*servicePort))
-
-		//注册服务
-		if !discoverClient.Register(*serviceName, instanceId, "/health", *serviceHost, *servicePort, nil, config.Logger) {
-			//注册失败
-			config.Logger.Printf("string-service for service %s failed.", serviceName)
-			os.Exit(-1)
-		}
-		handler := r
-		errChan <- http.ListenAndServe(":"+strconv.Itoa(*servicePort), handler)
+		errChan <- server.Serve(listener)
 	}()
 
 	//监控系统信号
@@ -86,7 +266,25 @@ func main() {
 	}()
 
 	error := <-errChan
-	//服务退出取消注册
-	discoverClient.Deregister(instanceId, config.Logger)
 	config.Logger.Println(error)
+	//开始退出后不再就绪
+	listening.Close("shutting down")
+	//先退出选主，让其他实例尽快接任leader
+	if elector != nil {
+		elector.Close()
+	}
+	//依次进入维护模式、等待传播、注销实例、排空处理中的请求
+	sequence := &shutdown.Sequence{
+		Registrar:        registrar,
+		Server:           server,
+		PropagationDelay: *shutdownDelay,
+		DrainTimeout:     *shutdownTimeout,
+		Logger:           config.Logger,
+	}
+	if err := sequence.Run(); err != nil {
+		config.Logger.Printf("shutdown of instance %s finished with error: %v", instanceId, err)
+	}
+	//停止动态配置和服务发现客户端的后台监控
+	kvConfig.Close()
+	discoverClient.Close()
 }
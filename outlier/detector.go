@@ -0,0 +1,251 @@
+package outlier
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+//被动的异常实例检测：根据调用方上报的每次调用结果统计每个实例的错误和延迟，
+//超过阈值的实例被驱逐一段时间，到期后进入半开状态放行少量探测请求，探测成功后恢复
+
+var ErrInstanceEjected = errors.New("instance ejected")
+
+//实例的熔断状态
+const (
+	StateClosed   = "closed"    //正常
+	StateOpen     = "open"      //已驱逐
+	StateHalfOpen = "half-open" //驱逐到期，正在探测
+)
+
+type Config struct {
+	ConsecutiveErrors  int           //连续失败多少次后驱逐，为0时不按连续失败驱逐
+	ErrorRate          float64       //统计窗口内错误率达到多少时驱逐，为0时不按错误率驱逐
+	MinRequests        int           //统计窗口内至少多少次请求才计算错误率
+	Interval           time.Duration //错误率的统计窗口
+	SlowThreshold      time.Duration //调用耗时超过该值时视为失败，为0时不统计慢调用
+	BaseEjectionTime   time.Duration //第一次驱逐的时长，之后每次驱逐翻倍
+	MaxEjectionTime    time.Duration //驱逐时长的上限
+	HalfOpenMaxRequest int           //半开状态下同时允许的探测请求数
+}
+
+//默认配置：连续5次失败或10秒内错误率超过50%时驱逐30秒
+func DefaultConfig() Config {
+	return Config{
+		ConsecutiveErrors:  5,
+		ErrorRate:          0.5,
+		MinRequests:        10,
+		Interval:           10 * time.Second,
+		SlowThreshold:      0,
+		BaseEjectionTime:   30 * time.Second,
+		MaxEjectionTime:    5 * time.Minute,
+		HalfOpenMaxRequest: 1,
+	}
+}
+
+//实例的统计信息和熔断状态，用于管理接口展示
+type InstanceStatus struct {
+	Instance          string        `json:"instance"`
+	State             string        `json:"state"`
+	ConsecutiveErrors int           `json:"consecutive_errors"`
+	Requests          int           `json:"requests"` //当前统计窗口内的请求数
+	Errors            int           `json:"errors"`   //当前统计窗口内的失败数
+	AvgLatency        time.Duration `json:"avg_latency"`
+	Ejections         int           `json:"ejections"` //累计被驱逐的次数
+	EjectedUntil      time.Time     `json:"ejected_until,omitempty"`
+}
+
+type instanceStats struct {
+	state             string
+	consecutiveErrors int
+	windowStart       time.Time
+	requests          int
+	errors            int
+	avgLatency        time.Duration
+	ejections         int
+	ejectedUntil      time.Time
+	probes            int //半开状态下正在进行的探测请求数
+}
+
+type Detector struct {
+	config    Config
+	mutex     sync.Mutex
+	instances map[string]*instanceStats
+	now       func() time.Time
+}
+
+func NewDetector(config Config) *Detector {
+	defaults := DefaultConfig()
+	if config.Interval <= 0 {
+		config.Interval = defaults.Interval
+	}
+	if config.BaseEjectionTime <= 0 {
+		config.BaseEjectionTime = defaults.BaseEjectionTime
+	}
+	if config.MaxEjectionTime < config.BaseEjectionTime {
+		config.MaxEjectionTime = config.BaseEjectionTime
+	}
+	if config.HalfOpenMaxRequest <= 0 {
+		config.HalfOpenMaxRequest = defaults.HalfOpenMaxRequest
+	}
+	return &Detector{
+		config:    config,
+		instances: make(map[string]*instanceStats),
+		now:       time.Now,
+	}
+}
+
+//判断是否可以向实例发起调用，半开状态下会占用一个探测名额，调用结束后必须通过Report上报结果
+func (d *Detector) Allow(instance string) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	stats := d.stats(instance)
+	switch stats.state {
+	case StateOpen:
+		if d.now().Before(stats.ejectedUntil) {
+			return false
+		}
+		stats.state = StateHalfOpen
+		stats.probes = 0
+		fallthrough
+	case StateHalfOpen:
+		if stats.probes >= d.config.HalfOpenMaxRequest {
+			return false
+		}
+		stats.probes++
+		return true
+	default:
+		return true
+	}
+}
+
+//判断实例当前是否被驱逐，不会占用探测名额
+func (d *Detector) Ejected(instance string) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	stats, ok := d.instances[instance]
+	if !ok {
+		return false
+	}
+	return stats.state == StateOpen && d.now().Before(stats.ejectedUntil)
+}
+
+//上报一次调用的结果
+func (d *Detector) Report(instance string, latency time.Duration, err error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	stats := d.stats(instance)
+	now := d.now()
+	//驱逐到期后没有经过Allow直接上报的调用也视为探测
+	if stats.state == StateOpen && !now.Before(stats.ejectedUntil) {
+		stats.state = StateHalfOpen
+		stats.probes = 1
+	}
+	failed := err != nil || (d.config.SlowThreshold > 0 && latency > d.config.SlowThreshold)
+
+	//延迟使用指数加权平均
+	if stats.avgLatency == 0 {
+		stats.avgLatency = latency
+	} else {
+		stats.avgLatency = (stats.avgLatency*4 + latency) / 5
+	}
+	if now.Sub(stats.windowStart) > d.config.Interval {
+		stats.windowStart = now
+		stats.requests = 0
+		stats.errors = 0
+	}
+	stats.requests++
+
+	if stats.state == StateHalfOpen {
+		if stats.probes > 0 {
+			stats.probes--
+		}
+		if failed {
+			d.eject(stats, now)
+		} else {
+			//探测成功，恢复正常
+			stats.state = StateClosed
+			stats.consecutiveErrors = 0
+			stats.windowStart = now
+			stats.requests = 0
+			stats.errors = 0
+		}
+		return
+	}
+	if !failed {
+		stats.consecutiveErrors = 0
+		return
+	}
+	stats.errors++
+	stats.consecutiveErrors++
+	if stats.state != StateClosed {
+		return
+	}
+	if d.config.ConsecutiveErrors > 0 && stats.consecutiveErrors >= d.config.ConsecutiveErrors {
+		d.eject(stats, now)
+		return
+	}
+	if d.config.ErrorRate > 0 && stats.requests >= d.config.MinRequests &&
+		float64(stats.errors)/float64(stats.requests) >= d.config.ErrorRate {
+		d.eject(stats, now)
+	}
+}
+
+//手动恢复实例
+func (d *Detector) Reset(instance string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	delete(d.instances, instance)
+}
+
+//所有实例的状态，按实例排序
+func (d *Detector) Status() []InstanceStatus {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	statuses := make([]InstanceStatus, 0, len(d.instances))
+	for instance, stats := range d.instances {
+		status := InstanceStatus{
+			Instance:          instance,
+			State:             stats.state,
+			ConsecutiveErrors: stats.consecutiveErrors,
+			Requests:          stats.requests,
+			Errors:            stats.errors,
+			AvgLatency:        stats.avgLatency,
+			Ejections:         stats.ejections,
+		}
+		if stats.state == StateOpen {
+			status.EjectedUntil = stats.ejectedUntil
+		}
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Instance < statuses[j].Instance
+	})
+	return statuses
+}
+
+//驱逐实例，驱逐时长随驱逐次数翻倍，需要持有锁
+func (d *Detector) eject(stats *instanceStats, now time.Time) {
+	ejectionTime := d.config.BaseEjectionTime
+	for i := 0; i < stats.ejections && ejectionTime < d.config.MaxEjectionTime; i++ {
+		ejectionTime *= 2
+	}
+	if ejectionTime > d.config.MaxEjectionTime {
+		ejectionTime = d.config.MaxEjectionTime
+	}
+	stats.state = StateOpen
+	stats.ejections++
+	stats.ejectedUntil = now.Add(ejectionTime)
+	stats.probes = 0
+}
+
+//需要持有锁
+func (d *Detector) stats(instance string) *instanceStats {
+	stats, ok := d.instances[instance]
+	if !ok {
+		stats = &instanceStats{state: StateClosed, windowStart: d.now()}
+		d.instances[instance] = stats
+	}
+	return stats
+}
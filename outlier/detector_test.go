@@ -0,0 +1,153 @@
+package outlier
+
+import (
+	"context"
+	"errors"
+	"github.com/go-kit/kit/endpoint"
+	"testing"
+	"time"
+)
+
+//使用可控时钟的Detector，驱逐时长为10s，最长40s
+func newTestDetector(config Config) (*Detector, *time.Time) {
+	now := time.Unix(1600000000, 0)
+	config.BaseEjectionTime = 10 * time.Second
+	config.MaxEjectionTime = 40 * time.Second
+	d := NewDetector(config)
+	d.now = func() time.Time { return now }
+	return d, &now
+}
+
+var errCall = errors.New("call failed")
+
+func assertState(t *testing.T, d *Detector, instance, want string) {
+	t.Helper()
+	for _, status := range d.Status() {
+		if status.Instance == instance {
+			if status.State != want {
+				t.Fatalf("state of %s = %s, want %s", instance, status.State, want)
+			}
+			return
+		}
+	}
+	t.Fatalf("no status for %s", instance)
+}
+
+//连续失败达到阈值时驱逐，成功的调用重新计数
+func TestEjectOnConsecutiveErrors(t *testing.T) {
+	d, _ := newTestDetector(Config{ConsecutiveErrors: 3})
+	d.Report("a", time.Millisecond, errCall)
+	d.Report("a", time.Millisecond, errCall)
+	d.Report("a", time.Millisecond, nil)
+	d.Report("a", time.Millisecond, errCall)
+	d.Report("a", time.Millisecond, errCall)
+	if d.Ejected("a") {
+		t.Fatal("ejected before 3 consecutive errors")
+	}
+	d.Report("a", time.Millisecond, errCall)
+	if !d.Ejected("a") || d.Allow("a") {
+		t.Fatal("not ejected after 3 consecutive errors")
+	}
+	assertState(t, d, "a", StateOpen)
+}
+
+//统计窗口内请求数达到MinRequests且错误率达到阈值时驱逐，慢调用视为失败
+func TestEjectOnErrorRate(t *testing.T) {
+	d, now := newTestDetector(Config{ErrorRate: 0.5, MinRequests: 4, Interval: time.Second, SlowThreshold: 100 * time.Millisecond})
+	d.Report("a", time.Millisecond, errCall)
+	d.Report("a", time.Millisecond, nil)
+	d.Report("a", time.Second, nil)
+	if d.Ejected("a") {
+		t.Fatal("ejected before MinRequests")
+	}
+	//窗口过期后重新统计
+	*now = now.Add(2 * time.Second)
+	d.Report("a", time.Millisecond, nil)
+	d.Report("a", time.Millisecond, nil)
+	d.Report("a", time.Millisecond, nil)
+	d.Report("a", time.Millisecond, errCall)
+	if d.Ejected("a") {
+		t.Fatal("ejected at 25% error rate")
+	}
+	d.Report("a", time.Second, nil)
+	d.Report("a", time.Millisecond, errCall)
+	if !d.Ejected("a") {
+		t.Fatal("not ejected at 50% error rate")
+	}
+}
+
+//驱逐到期后进入半开状态，只放行HalfOpenMaxRequest个探测请求；探测失败时再次驱逐，时长翻倍直到上限
+func TestEjectionBackoffAndHalfOpen(t *testing.T) {
+	d, now := newTestDetector(Config{ConsecutiveErrors: 1, HalfOpenMaxRequest: 1})
+	d.Report("a", time.Millisecond, errCall)
+	for _, ejection := range []time.Duration{10 * time.Second, 20 * time.Second, 40 * time.Second, 40 * time.Second} {
+		*now = now.Add(ejection - time.Millisecond)
+		if d.Allow("a") {
+			t.Fatalf("allowed before the %s ejection expired", ejection)
+		}
+		*now = now.Add(time.Millisecond)
+		if !d.Allow("a") {
+			t.Fatalf("probe not allowed after the %s ejection expired", ejection)
+		}
+		assertState(t, d, "a", StateHalfOpen)
+		if d.Allow("a") {
+			t.Fatal("allowed a second concurrent probe")
+		}
+		d.Report("a", time.Millisecond, errCall)
+		assertState(t, d, "a", StateOpen)
+	}
+}
+
+//探测成功后恢复，之后需要重新达到阈值才会驱逐
+func TestReadmitAfterSuccessfulProbe(t *testing.T) {
+	d, now := newTestDetector(Config{ConsecutiveErrors: 2, HalfOpenMaxRequest: 2})
+	d.Report("a", time.Millisecond, errCall)
+	d.Report("a", time.Millisecond, errCall)
+	*now = now.Add(10 * time.Second)
+	if !d.Allow("a") || !d.Allow("a") || d.Allow("a") {
+		t.Fatal("want exactly 2 probes in the half-open state")
+	}
+	d.Report("a", time.Millisecond, nil)
+	assertState(t, d, "a", StateClosed)
+	if !d.Allow("a") || d.Ejected("a") {
+		t.Fatal("instance not readmitted")
+	}
+	d.Report("a", time.Millisecond, errCall)
+	if d.Ejected("a") {
+		t.Fatal("ejected by a single error after readmission")
+	}
+	d.Report("a", time.Millisecond, errCall)
+	if !d.Ejected("a") {
+		t.Fatal("not ejected after readmission")
+	}
+	for _, status := range d.Status() {
+		if status.Ejections != 2 {
+			t.Fatalf("ejections = %d, want 2", status.Ejections)
+		}
+	}
+	//手动恢复
+	d.Reset("a")
+	if d.Ejected("a") || len(d.Status()) != 0 {
+		t.Fatal("Reset did not readmit the instance")
+	}
+}
+
+//被驱逐的实例通过中间件快速失败，不调用下游
+func TestMiddlewareFailsFastWhenEjected(t *testing.T) {
+	d, _ := newTestDetector(Config{ConsecutiveErrors: 1})
+	calls := 0
+	var next endpoint.Endpoint = func(ctx context.Context, request interface{}) (interface{}, error) {
+		calls++
+		return nil, errCall
+	}
+	e := d.Middleware("a")(next)
+	if _, err := e(context.Background(), nil); err != errCall {
+		t.Fatalf("first call = %v, want %v", err, errCall)
+	}
+	if _, err := e(context.Background(), nil); err != ErrInstanceEjected {
+		t.Fatalf("second call = %v, want ErrInstanceEjected", err)
+	}
+	if calls != 1 {
+		t.Fatalf("downstream called %d times, want 1", calls)
+	}
+}
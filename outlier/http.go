@@ -0,0 +1,34 @@
+package outlier
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+//管理接口：GET返回所有实例的统计信息和熔断状态，DELETE ?instance=host:port手动恢复实例
+func MakeHttpHandler(d *Detector) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json;charset=utf-8")
+		switch r.Method {
+		case http.MethodGet:
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"instances": d.Status(),
+			})
+		case http.MethodDelete:
+			instance := r.URL.Query().Get("instance")
+			if instance == "" {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"error": "instance is required",
+				})
+				return
+			}
+			d.Reset(instance)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"instance": instance,
+			})
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	})
+}
@@ -0,0 +1,83 @@
+package outlier
+
+import (
+	"context"
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/sd"
+	"gomicro-discover/discover"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+//将Detector接入go-kit的endpoint和sd.Factory，以及balancer的实例过滤
+
+//实例在Detector中的标识，与go-kit sd使用的host:port一致
+func InstanceKey(instance *discover.ServiceInstance) string {
+	return net.JoinHostPort(instance.Address, strconv.Itoa(instance.Port))
+}
+
+//单个实例的熔断中间件：实例被驱逐时直接返回ErrInstanceEjected，否则记录调用结果和耗时
+func (d *Detector) Middleware(instance string) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+			if !d.Allow(instance) {
+				return nil, ErrInstanceEjected
+			}
+			defer func(begin time.Time) {
+				d.Report(instance, time.Since(begin), err)
+			}(time.Now())
+			return next(ctx, request)
+		}
+	}
+}
+
+//为factory创建的每个实例endpoint加上熔断中间件，
+//与lb.Retry配合时被驱逐的实例会快速失败并重试其他实例。
+//实例从服务发现中移除时sd.Endpointer会关闭对应的Closer，此时同时删除实例的统计信息
+func (d *Detector) Factory(factory sd.Factory) sd.Factory {
+	return func(instance string) (endpoint.Endpoint, io.Closer, error) {
+		e, closer, err := factory(instance)
+		if err != nil {
+			return nil, nil, err
+		}
+		return d.Middleware(instance)(e), &instanceCloser{closer: closer, forget: func() { d.Reset(instance) }}, nil
+	}
+}
+
+//关闭实例endpoint时删除实例的统计信息
+type instanceCloser struct {
+	closer io.Closer //factory返回的Closer，可能为nil
+	forget func()
+}
+
+func (c *instanceCloser) Close() error {
+	c.forget()
+	if c.closer == nil {
+		return nil
+	}
+	return c.closer.Close()
+}
+
+//订阅服务的变化，删除被移除的实例的统计信息，直到ctx结束。
+//通过balancer.WithFilter使用Detector时需要调用，通过Factory接入go-kit sd时不需要
+func (d *Detector) Watch(ctx context.Context, client discover.Client, serviceName string) error {
+	events, err := client.Subscribe(ctx, serviceName)
+	if err != nil {
+		return err
+	}
+	go func() {
+		for event := range events {
+			for _, instance := range event.Removed {
+				d.Reset(InstanceKey(instance))
+			}
+		}
+	}()
+	return nil
+}
+
+//用于balancer.WithFilter，过滤掉被驱逐的实例
+func (d *Detector) Available(instance *discover.ServiceInstance) bool {
+	return !d.Ejected(InstanceKey(instance))
+}
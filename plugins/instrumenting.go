@@ -0,0 +1,89 @@
+package plugins
+
+import (
+	"context"
+	"github.com/go-kit/kit/metrics"
+	"gomicro-discover/discover"
+	"gomicro-discover/health"
+	"gomicro-discover/service"
+	"time"
+)
+
+//与string-service的指标中间件相同，使用装饰者模式按method标签记录service接口每个方法的调用次数、错误次数和耗时。
+//指标使用go-kit的metrics接口，可以替换为prometheus之外的后端
+
+type instrumentingMiddleware struct {
+	service.Service
+	requestCount   metrics.Counter   //调用次数
+	errorCount     metrics.Counter   //返回错误或检查失败的次数
+	requestLatency metrics.Histogram //耗时，单位为秒
+}
+
+//三个指标都需要支持method标签
+func InstrumentingMiddleware(requestCount, errorCount metrics.Counter, requestLatency metrics.Histogram) service.ServiceMiddleware {
+	return func(next service.Service) service.Service {
+		return instrumentingMiddleware{
+			Service:        next,
+			requestCount:   requestCount,
+			errorCount:     errorCount,
+			requestLatency: requestLatency,
+		}
+	}
+}
+
+//记录一次调用，failed为true时同时记录错误
+func (mw instrumentingMiddleware) observe(method string, begin time.Time, failed bool) {
+	mw.requestCount.With("method", method).Add(1)
+	if failed {
+		mw.errorCount.With("method", method).Add(1)
+	}
+	mw.requestLatency.With("method", method).Observe(time.Since(begin).Seconds())
+}
+
+func (mw instrumentingMiddleware) SayHello() (ret string) {
+	defer func(begin time.Time) {
+		mw.observe("SayHello", begin, false)
+	}(time.Now())
+	ret = mw.Service.SayHello()
+	return ret
+}
+
+func (mw instrumentingMiddleware) DiscoveryService(ctx context.Context, serviceName string, opts ...discover.QueryOption) (ret []*discover.ServiceInstance, err error) {
+	defer func(begin time.Time) {
+		mw.observe("DiscoveryService", begin, err != nil)
+	}(time.Now())
+	ret, err = mw.Service.DiscoveryService(ctx, serviceName, opts...)
+	return ret, err
+}
+
+func (mw instrumentingMiddleware) Leader(ctx context.Context, serviceName string) (ret string, err error) {
+	defer func(begin time.Time) {
+		mw.observe("Leader", begin, err != nil)
+	}(time.Now())
+	ret, err = mw.Service.Leader(ctx, serviceName)
+	return ret, err
+}
+
+func (mw instrumentingMiddleware) HealthCheck() (ret bool) {
+	defer func(begin time.Time) {
+		mw.observe("HealthCheck", begin, !ret)
+	}(time.Now())
+	ret = mw.Service.HealthCheck()
+	return ret
+}
+
+func (mw instrumentingMiddleware) Liveness(ctx context.Context) (ret health.Report) {
+	defer func(begin time.Time) {
+		mw.observe("Liveness", begin, !ret.Healthy())
+	}(time.Now())
+	ret = mw.Service.Liveness(ctx)
+	return ret
+}
+
+func (mw instrumentingMiddleware) Readiness(ctx context.Context) (ret health.Report) {
+	defer func(begin time.Time) {
+		mw.observe("Readiness", begin, !ret.Healthy())
+	}(time.Now())
+	ret = mw.Service.Readiness(ctx)
+	return ret
+}
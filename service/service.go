@@ -3,47 +3,107 @@ package service
 import (
 	"context"
 	"errors"
-	"gomicro-discover/config"
 	"gomicro-discover/discover"
+	"gomicro-discover/health"
+	"sync/atomic"
 )
 
 //服务接口
 
 type Service interface {
-	//健康检查接口
+	//健康检查接口，就绪检查的整体状态不为fail时返回true
 	HealthCheck() bool
+	//存活检查报告，失败时应重启实例
+	Liveness(ctx context.Context) health.Report
+	//就绪检查报告，失败时不应再接收流量
+	Readiness(ctx context.Context) health.Report
 	//打招呼接口
 	SayHello() string
-	//服务发现接口
-	DiscoveryService(ctx context.Context, serviceName string) ([]interface{}, error)
+	//服务发现接口，opts为标签、元数据等过滤条件
+	DiscoveryService(ctx context.Context, serviceName string, opts ...discover.QueryOption) ([]*discover.ServiceInstance, error)
+	//查询服务当前leader的实例ID
+	Leader(ctx context.Context, serviceName string) (string, error)
 }
 
-var errNotServiceInstance = errors.New("instances are not existed")
+//查询服务的leader，由leader.Resolver实现
+type LeaderResolver interface {
+	Leader(ctx context.Context, serviceName string) (string, error)
+}
+
+var (
+	errNotServiceInstance = errors.New("instances are not existed")
+	errLeaderDisabled     = errors.New("leader lookup is not enabled")
+)
+
+//SayHello默认返回的问候语
+const DefaultGreeting = "hello world ha!"
 
 type DiscoveryServiceImpl struct {
-	discoverClient discover.DiscoveryClient
+	discoverClient discover.Client
+	//为nil时不支持查询leader
+	leaders LeaderResolver
+	//SayHello返回的问候语，可以在运行时修改
+	greeting atomic.Value
+	//存活和就绪检查，为nil时始终健康
+	checks health.Checks
 }
 
-//返回Service接口，DiscoveryServiceImpl必须实现了Service接口
-func NewDiscoverServiceImpl(discoverClient discover.DiscoveryClient) Service {
-	return &DiscoveryServiceImpl{
+//DiscoveryServiceImpl必须实现了Service接口
+var _ Service = (*DiscoveryServiceImpl)(nil)
+
+func NewDiscoverServiceImpl(discoverClient discover.Client, leaders LeaderResolver, checks health.Checks) *DiscoveryServiceImpl {
+	service := &DiscoveryServiceImpl{
 		discoverClient: discoverClient,
+		leaders:        leaders,
+		checks:         checks,
 	}
+	service.greeting.Store(DefaultGreeting)
+	return service
+}
+
+//修改SayHello返回的问候语，greeting为空时恢复为DefaultGreeting
+func (service *DiscoveryServiceImpl) SetGreeting(greeting string) {
+	if greeting == "" {
+		greeting = DefaultGreeting
+	}
+	service.greeting.Store(greeting)
 }
 
 func (service *DiscoveryServiceImpl) SayHello() string {
-	return "hello world ha!"
+	return service.greeting.Load().(string)
 }
 
-func (service *DiscoveryServiceImpl) DiscoveryService(ctx context.Context, serviceName string) ([]interface{}, error) {
-	instances := service.discoverClient.DiscoverService(serviceName, config.Logger)
-	if instances == nil || len(instances) == 0 {
+func (service *DiscoveryServiceImpl) DiscoveryService(ctx context.Context, serviceName string, opts ...discover.QueryOption) ([]*discover.ServiceInstance, error) {
+	instances, err := service.discoverClient.DiscoverService(ctx, serviceName, opts...)
+	if errors.Is(err, discover.ErrServiceNotFound) || (err == nil && len(instances) == 0) {
 		return nil, errNotServiceInstance
 	}
+	if err != nil {
+		return nil, err
+	}
 	return instances, nil
 }
 
-//用于检测服务的健康状态，这里不做处理，直接返回true
+func (service *DiscoveryServiceImpl) Leader(ctx context.Context, serviceName string) (string, error) {
+	if service.leaders == nil {
+		return "", errLeaderDisabled
+	}
+	return service.leaders.Leader(ctx, serviceName)
+}
+
+//用于检测服务的健康状态，TTL心跳上报前也会调用
 func (service *DiscoveryServiceImpl) HealthCheck() bool {
-	return true
+	return service.Readiness(context.Background()).Healthy()
+}
+
+func (service *DiscoveryServiceImpl) Liveness(ctx context.Context) health.Report {
+	return service.checks.Liveness.Check(ctx)
+}
+
+//执行注册的全部就绪检查，如监听是否建立、consul是否可达、服务发现缓存是否新鲜
+func (service *DiscoveryServiceImpl) Readiness(ctx context.Context) health.Report {
+	return service.checks.Readiness.Check(ctx)
 }
+
+//定义服务的中间件：用于在service层注入指标记录等行为
+type ServiceMiddleware func(Service) Service
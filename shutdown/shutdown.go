@@ -0,0 +1,100 @@
+package shutdown
+
+import (
+	"context"
+	"errors"
+	"gomicro-discover/discover"
+	"log"
+	"os"
+	"time"
+)
+
+//优雅退出：先将实例置为维护模式并等待状态传播到调用方的缓存，再注销实例，
+//最后关闭http server并等待处理中的请求完成，避免退出时丢弃请求
+
+const (
+	DefaultPropagationDelay = 5 * time.Second
+	DefaultDrainTimeout     = 15 * time.Second
+	//维护模式和注销请求的超时时间
+	requestTimeout = 5 * time.Second
+)
+
+//需要排空请求的server，*http.Server实现了该接口
+type Server interface {
+	Shutdown(ctx context.Context) error
+}
+
+type Sequence struct {
+	//负责服务实例注册的registrar，为nil时跳过维护模式和注销
+	Registrar *discover.Registrar
+	//需要排空请求的server，为nil时跳过
+	Server Server
+	//进入维护模式后等待调用方感知的时间，没有进入维护模式时不等待
+	PropagationDelay time.Duration
+	//等待处理中的请求完成的最长时间
+	DrainTimeout time.Duration
+	//记录每个阶段，为nil时使用标准库默认的logger
+	Logger *log.Logger
+}
+
+//依次执行退出的各个阶段，某个阶段失败时记录错误并继续执行后续阶段，返回第一个错误
+func (s *Sequence) Run() error {
+	logger := s.Logger
+	if logger == nil {
+		logger = log.New(os.Stderr, "", log.LstdFlags)
+	}
+	var firstErr error
+	fail := func(err error) {
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	start := time.Now()
+
+	if s.Registrar != nil {
+		logger.Println("shutdown: entering maintenance mode")
+		ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+		err := s.Registrar.EnterMaintenance(ctx, "shutting down")
+		cancel()
+		switch {
+		case errors.Is(err, discover.ErrMaintenanceUnsupported):
+			logger.Println("shutdown: maintenance mode not supported by the discovery client, skipped")
+		case err != nil:
+			logger.Printf("shutdown: enter maintenance mode failed: %v", err)
+			fail(err)
+		}
+
+		//没有进入维护模式时没有需要传播的变化，直接注销
+		if err == nil && s.PropagationDelay > 0 {
+			logger.Printf("shutdown: waiting %s for the change to propagate", s.PropagationDelay)
+			time.Sleep(s.PropagationDelay)
+		}
+
+		logger.Println("shutdown: deregistering instance")
+		ctx, cancel = context.WithTimeout(context.Background(), requestTimeout)
+		err = s.Registrar.Deregister(ctx)
+		cancel()
+		if err != nil {
+			logger.Printf("shutdown: deregister failed: %v", err)
+			fail(err)
+		}
+	}
+
+	if s.Server != nil {
+		timeout := s.DrainTimeout
+		if timeout <= 0 {
+			timeout = DefaultDrainTimeout
+		}
+		logger.Printf("shutdown: draining in-flight requests, deadline %s", timeout)
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		err := s.Server.Shutdown(ctx)
+		cancel()
+		if err != nil {
+			logger.Printf("shutdown: drain failed: %v", err)
+			fail(err)
+		}
+	}
+
+	logger.Printf("shutdown: completed in %s", time.Since(start).Round(time.Millisecond))
+	return firstErr
+}
@@ -0,0 +1,254 @@
+package shutdown_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"gomicro-discover/discover"
+	"gomicro-discover/discover/discovertest"
+	"gomicro-discover/shutdown"
+	"log"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+//按发生顺序记录各个阶段
+type recorder struct {
+	mutex  sync.Mutex
+	phases []string
+	times  []time.Time
+}
+
+func (r *recorder) record(phase string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.phases = append(r.phases, phase)
+	r.times = append(r.times, time.Now())
+}
+
+//记录维护模式和注销的调用
+type recordingClient struct {
+	*discovertest.Client
+	recorder *recorder
+}
+
+func (c *recordingClient) SetMaintenance(ctx context.Context, instanceId string, enable bool, reason string) error {
+	c.recorder.record("maintenance")
+	return c.Client.SetMaintenance(ctx, instanceId, enable, reason)
+}
+
+func (c *recordingClient) Deregister(ctx context.Context, instanceId string) error {
+	c.recorder.record("deregister")
+	return c.Client.Deregister(ctx, instanceId)
+}
+
+//不支持维护模式的客户端
+type basicClient struct {
+	discover.Client
+}
+
+//记录Shutdown调用的server，block为true时等待ctx结束
+type fakeServer struct {
+	recorder *recorder
+	err      error
+	block    bool
+	deadline time.Time
+}
+
+func (s *fakeServer) Shutdown(ctx context.Context) error {
+	s.recorder.record("shutdown")
+	s.deadline, _ = ctx.Deadline()
+	if s.block {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	return s.err
+}
+
+//创建已经注册成功的registrar
+func newRegistrar(t *testing.T, client discover.Client) *discover.Registrar {
+	t.Helper()
+	registrar := discover.NewRegistrar(client, &discover.Registration{
+		ServiceName:  "string",
+		InstanceId:   "string-1",
+		InstanceHost: "127.0.0.1",
+		InstancePort: 10085,
+	}, discover.WithRegistrarLogger(log.New(&bytes.Buffer{}, "", 0)))
+	registrar.Start()
+	deadline := time.Now().Add(5 * time.Second)
+	for !registrar.Registered() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for registration")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return registrar
+}
+
+//日志中各阶段的行，去掉耗时等变化的部分
+func logLines(buf *bytes.Buffer) []string {
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	for i, line := range lines {
+		if strings.HasPrefix(line, "shutdown: completed in ") {
+			lines[i] = "shutdown: completed"
+		}
+	}
+	return lines
+}
+
+func assertLines(t *testing.T, got, want []string) {
+	t.Helper()
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("log lines:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestSequenceOrder(t *testing.T) {
+	recorder := &recorder{}
+	client := &recordingClient{Client: discovertest.NewClient(), recorder: recorder}
+	registrar := newRegistrar(t, client)
+	var buf bytes.Buffer
+	sequence := &shutdown.Sequence{
+		Registrar:        registrar,
+		Server:           &fakeServer{recorder: recorder},
+		PropagationDelay: 50 * time.Millisecond,
+		DrainTimeout:     time.Second,
+		Logger:           log.New(&buf, "", 0),
+	}
+	if err := sequence.Run(); err != nil {
+		t.Fatalf("Run() = %v", err)
+	}
+
+	if got := strings.Join(recorder.phases, ","); got != "maintenance,deregister,shutdown" {
+		t.Fatalf("phases = %s, want maintenance,deregister,shutdown", got)
+	}
+	//注销前需要等待维护模式传播
+	if gap := recorder.times[1].Sub(recorder.times[0]); gap < sequence.PropagationDelay {
+		t.Fatalf("deregistered %s after entering maintenance, want at least %s", gap, sequence.PropagationDelay)
+	}
+	assertLines(t, logLines(&buf), []string{
+		"shutdown: entering maintenance mode",
+		"shutdown: waiting 50ms for the change to propagate",
+		"shutdown: deregistering instance",
+		"shutdown: draining in-flight requests, deadline 1s",
+		"shutdown: completed",
+	})
+	if state := registrar.Status().State; state != discover.RegistrationDeregistered {
+		t.Fatalf("registration state = %s, want %s", state, discover.RegistrationDeregistered)
+	}
+	if _, ok := client.Registration("string-1"); ok {
+		t.Fatal("instance is still registered")
+	}
+}
+
+//不支持维护模式时跳过该阶段和传播等待，继续注销和排空
+func TestSequenceMaintenanceUnsupported(t *testing.T) {
+	recorder := &recorder{}
+	client := discovertest.NewClient()
+	registrar := newRegistrar(t, basicClient{client})
+	var buf bytes.Buffer
+	sequence := &shutdown.Sequence{
+		Registrar:        registrar,
+		Server:           &fakeServer{recorder: recorder},
+		PropagationDelay: time.Minute,
+		Logger:           log.New(&buf, "", 0),
+	}
+	start := time.Now()
+	if err := sequence.Run(); err != nil {
+		t.Fatalf("Run() = %v", err)
+	}
+	if took := time.Since(start); took > 5*time.Second {
+		t.Fatalf("Run() took %s, want the propagation delay skipped", took)
+	}
+	assertLines(t, logLines(&buf), []string{
+		"shutdown: entering maintenance mode",
+		"shutdown: maintenance mode not supported by the discovery client, skipped",
+		"shutdown: deregistering instance",
+		"shutdown: draining in-flight requests, deadline 15s",
+		"shutdown: completed",
+	})
+	if client.Calls(discovertest.OpMaintenance) != 0 || client.Calls(discovertest.OpDeregister) != 1 {
+		t.Fatalf("maintenance calls = %d, deregister calls = %d, want 0 and 1",
+			client.Calls(discovertest.OpMaintenance), client.Calls(discovertest.OpDeregister))
+	}
+}
+
+//某个阶段失败时继续执行后续阶段，返回第一个错误；进入维护模式失败时不等待传播
+func TestSequenceErrors(t *testing.T) {
+	recorder := &recorder{}
+	client := &recordingClient{Client: discovertest.NewClient(), recorder: recorder}
+	registrar := newRegistrar(t, client)
+	errMaintenance := errors.New("maintenance failed")
+	errDeregister := errors.New("deregister failed")
+	errShutdown := errors.New("shutdown failed")
+	client.SetError(discovertest.OpMaintenance, errMaintenance)
+	client.SetError(discovertest.OpDeregister, errDeregister)
+	var buf bytes.Buffer
+	sequence := &shutdown.Sequence{
+		Registrar:        registrar,
+		Server:           &fakeServer{recorder: recorder, err: errShutdown},
+		PropagationDelay: time.Minute,
+		DrainTimeout:     time.Second,
+		Logger:           log.New(&buf, "", 0),
+	}
+	start := time.Now()
+	if err := sequence.Run(); err != errMaintenance {
+		t.Fatalf("Run() = %v, want %v", err, errMaintenance)
+	}
+	if took := time.Since(start); took > 5*time.Second {
+		t.Fatalf("Run() took %s, want the propagation delay skipped", took)
+	}
+	if got := strings.Join(recorder.phases, ","); got != "maintenance,deregister,shutdown" {
+		t.Fatalf("phases = %s, want maintenance,deregister,shutdown", got)
+	}
+	assertLines(t, logLines(&buf), []string{
+		"shutdown: entering maintenance mode",
+		"shutdown: enter maintenance mode failed: maintenance failed",
+		"shutdown: deregistering instance",
+		"shutdown: deregister failed: deregister failed",
+		"shutdown: draining in-flight requests, deadline 1s",
+		"shutdown: drain failed: shutdown failed",
+		"shutdown: completed",
+	})
+}
+
+//处理中的请求在DrainTimeout内没有完成时返回ctx的错误
+func TestSequenceDrainDeadline(t *testing.T) {
+	recorder := &recorder{}
+	server := &fakeServer{recorder: recorder, block: true}
+	var buf bytes.Buffer
+	sequence := &shutdown.Sequence{
+		Server:       server,
+		DrainTimeout: 50 * time.Millisecond,
+		Logger:       log.New(&buf, "", 0),
+	}
+	start := time.Now()
+	err := sequence.Run()
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Run() = %v, want context.DeadlineExceeded", err)
+	}
+	if took := time.Since(start); took < sequence.DrainTimeout || took > time.Second {
+		t.Fatalf("drain took %s, want about %s", took, sequence.DrainTimeout)
+	}
+	assertLines(t, logLines(&buf), []string{
+		"shutdown: draining in-flight requests, deadline 50ms",
+		"shutdown: drain failed: context deadline exceeded",
+		"shutdown: completed",
+	})
+}
+
+//没有设置DrainTimeout时使用默认的排空时间
+func TestSequenceDefaultDrainTimeout(t *testing.T) {
+	server := &fakeServer{recorder: &recorder{}}
+	sequence := &shutdown.Sequence{Server: server, Logger: log.New(&bytes.Buffer{}, "", 0)}
+	start := time.Now()
+	if err := sequence.Run(); err != nil {
+		t.Fatalf("Run() = %v", err)
+	}
+	end := time.Now()
+	if server.deadline.Before(start.Add(shutdown.DefaultDrainTimeout)) || server.deadline.After(end.Add(shutdown.DefaultDrainTimeout)) {
+		t.Fatalf("drain deadline %s after start, want %s", server.deadline.Sub(start), shutdown.DefaultDrainTimeout)
+	}
+}
@@ -0,0 +1,84 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/log"
+	"gomicro-discover/discover"
+	"gomicro-discover/discover/kitsd"
+	"gomicro-discover/outlier"
+	stringendpoint "gomicro-discover/string-service/endpoint"
+	"gomicro-discover/tracing"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+//string-service的客户端：通过服务发现找到string-service的实例，
+//返回带负载均衡和重试的endpoint，请求为endpoint.StringRequest，响应为endpoint.StringResponse
+
+//例：
+//	instancer, _ := kitsd.NewInstancer(discoverClient, "string", logger)
+//	defer instancer.Stop()
+//	stringEndpoint := client.MakeStringEndpoint(instancer, logger, 3, time.Second, outlier.NewDetector(outlier.DefaultConfig()))
+//	resp, err := stringEndpoint(ctx, endpoint.StringRequest{RequestType: "Concat", A: "a", B: "b"})
+
+//按服务名订阅string-service的实例并创建endpoint，返回的instancer需要在不再使用时Stop
+//detector不为空时对每个实例熔断，被驱逐的实例快速失败并由重试切换到其他实例
+func NewStringEndpoint(discoverClient discover.Client, serviceName string, logger log.Logger, retryMax int, timeout time.Duration, detector *outlier.Detector) (endpoint.Endpoint, *kitsd.Instancer, error) {
+	instancer, err := kitsd.NewInstancer(discoverClient, serviceName, logger)
+	if err != nil {
+		return nil, nil, err
+	}
+	return MakeStringEndpoint(instancer, logger, retryMax, timeout, detector), instancer, nil
+}
+
+//基于instancer创建调用/op/{type}/{a}/{b}的endpoint
+func MakeStringEndpoint(instancer *kitsd.Instancer, logger log.Logger, retryMax int, timeout time.Duration, detector *outlier.Detector) endpoint.Endpoint {
+	//请求头中携带W3C追踪上下文，string-service的span成为调用方span的子span
+	factory := kitsd.NewHTTPFactory("POST", "http", "/op", encodeStringRequest, decodeStringResponse, tracing.ClientOptions("POST /op/{type}")...)
+	if detector != nil {
+		factory = detector.Factory(factory)
+	}
+	return kitsd.NewRetryEndpoint(instancer, factory, logger, retryMax, timeout)
+}
+
+//将请求参数编码到路径中
+func encodeStringRequest(_ context.Context, r *http.Request, request interface{}) error {
+	req, ok := request.(stringendpoint.StringRequest)
+	if !ok {
+		return fmt.Errorf("unexpected request type %T", request)
+	}
+	//参数中可能包含/等特殊字符，同时设置转义后的RawPath
+	r.URL.Path = "/op/" + req.RequestType + "/" + req.A + "/" + req.B
+	r.URL.RawPath = "/op/" + url.PathEscape(req.RequestType) + "/" + url.PathEscape(req.A) + "/" + url.PathEscape(req.B)
+	return nil
+}
+
+func decodeStringResponse(_ context.Context, r *http.Response) (interface{}, error) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	//服务端出错时返回{"error": "..."}
+	if r.StatusCode != http.StatusOK {
+		var errResp struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(body, &errResp) == nil && errResp.Error != "" {
+			return nil, errors.New(errResp.Error)
+		}
+		return nil, fmt.Errorf("string-service returned status %d", r.StatusCode)
+	}
+	var resp struct {
+		Result string `json:"result"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, err
+	}
+	return stringendpoint.StringResponse{Result: resp.Result}, nil
+}
@@ -6,6 +6,12 @@ import (
 	"os"
 )
 
+//consul KV中的动态配置项，位于-config.prefix指定的目录下
+const (
+	//拼接结果的最大长度
+	KeyStrMaxSize = "str_max_size"
+)
+
 var (
 	Logger    *log.Logger
 	KitLogger kitlog.Logger
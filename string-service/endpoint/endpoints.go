@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"github.com/go-kit/kit/endpoint"
+	"gomicro-discover/health"
 	"gomicro-discover/string-service/service"
 	"strings"
 )
@@ -49,19 +50,37 @@ func MakeStringEndpoint(svc service.Service) endpoint.Endpoint {
 	}
 }
 
+//健康检查的类型
+const (
+	ProbeLiveness  = "live"  //存活检查
+	ProbeReadiness = "ready" //就绪检查
+)
+
+//健康检查请求结构体，Probe为空时按就绪检查处理
 type HealthRequest struct {
+	Probe string
 }
 
+//各个组件的健康检查报告
 type HealthResponse struct {
-	Status bool `json:"status"`
+	health.Report
+}
+
+//实现kithttp.StatusCoder，整体状态为fail时返回503
+func (r HealthResponse) StatusCode() int {
+	return r.HTTPStatus()
 }
 
 //创建健康检查的endpoint
 func MakeHealthCheckEndpoint(svc service.Service) endpoint.Endpoint {
 	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
-		status := svc.HealthCheck()
+		req := request.(HealthRequest)
+		report := svc.Readiness
+		if req.Probe == ProbeLiveness {
+			report = svc.Liveness
+		}
 		return HealthResponse{
-			Status: status,
+			Report: report(ctx),
 		}, nil
 	}
 }
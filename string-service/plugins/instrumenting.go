@@ -0,0 +1,85 @@
+package plugins
+
+import (
+	"context"
+	"github.com/go-kit/kit/metrics"
+	"gomicro-discover/health"
+	"gomicro-discover/string-service/service"
+	"time"
+)
+
+//与loggingMiddleware相同，使用装饰者模式定义instrumentingMiddleware指标中间件，
+//按method标签记录service接口每个方法的调用次数、错误次数和耗时，以及Concat和Diff的输入长度。
+//指标使用go-kit的metrics接口，可以替换为prometheus之外的后端
+
+type instrumentingMiddleware struct {
+	service.Service
+	requestCount   metrics.Counter   //调用次数
+	errorCount     metrics.Counter   //返回错误或检查失败的次数
+	requestLatency metrics.Histogram //耗时，单位为秒
+	inputSize      metrics.Histogram //两个输入字符串的总长度，单位为字节
+}
+
+//四个指标都需要支持method标签
+func InstrumentingMiddleware(requestCount, errorCount metrics.Counter, requestLatency, inputSize metrics.Histogram) service.ServiceMiddleware {
+	return func(next service.Service) service.Service {
+		return instrumentingMiddleware{
+			Service:        next,
+			requestCount:   requestCount,
+			errorCount:     errorCount,
+			requestLatency: requestLatency,
+			inputSize:      inputSize,
+		}
+	}
+}
+
+//记录一次调用，failed为true时同时记录错误
+func (mw instrumentingMiddleware) observe(method string, begin time.Time, failed bool) {
+	mw.requestCount.With("method", method).Add(1)
+	if failed {
+		mw.errorCount.With("method", method).Add(1)
+	}
+	mw.requestLatency.With("method", method).Observe(time.Since(begin).Seconds())
+}
+
+func (mw instrumentingMiddleware) Concat(a, b string) (ret string, err error) {
+	defer func(begin time.Time) {
+		mw.observe("Concat", begin, err != nil)
+	}(time.Now())
+	mw.inputSize.With("method", "Concat").Observe(float64(len(a) + len(b)))
+	ret, err = mw.Service.Concat(a, b)
+	return ret, err
+}
+
+func (mw instrumentingMiddleware) Diff(a, b string) (ret string, err error) {
+	defer func(begin time.Time) {
+		mw.observe("Diff", begin, err != nil)
+	}(time.Now())
+	mw.inputSize.With("method", "Diff").Observe(float64(len(a) + len(b)))
+	ret, err = mw.Service.Diff(a, b)
+	return ret, err
+}
+
+func (mw instrumentingMiddleware) HealthCheck() (ret bool) {
+	defer func(begin time.Time) {
+		mw.observe("HealthCheck", begin, !ret)
+	}(time.Now())
+	ret = mw.Service.HealthCheck()
+	return ret
+}
+
+func (mw instrumentingMiddleware) Liveness(ctx context.Context) (ret health.Report) {
+	defer func(begin time.Time) {
+		mw.observe("Liveness", begin, !ret.Healthy())
+	}(time.Now())
+	ret = mw.Service.Liveness(ctx)
+	return ret
+}
+
+func (mw instrumentingMiddleware) Readiness(ctx context.Context) (ret health.Report) {
+	defer func(begin time.Time) {
+		mw.observe("Readiness", begin, !ret.Healthy())
+	}(time.Now())
+	ret = mw.Service.Readiness(ctx)
+	return ret
+}
@@ -1,7 +1,9 @@
 package plugins
 
 import (
+	"context"
 	log2 "github.com/go-kit/kit/log"
+	"gomicro-discover/health"
 	"gomicro-discover/string-service/service"
 	"time"
 )
@@ -61,3 +63,27 @@ func (mw loggingMiddleware) HealthCheck() (ret bool) {
 	ret = mw.Service.HealthCheck()
 	return ret
 }
+
+func (mw loggingMiddleware) Liveness(ctx context.Context) (ret health.Report) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"function", "Liveness",
+			"result", ret.Status,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	ret = mw.Service.Liveness(ctx)
+	return ret
+}
+
+func (mw loggingMiddleware) Readiness(ctx context.Context) (ret health.Report) {
+	defer func(begin time.Time) {
+		mw.logger.Log(
+			"function", "Readiness",
+			"result", ret.Status,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	ret = mw.Service.Readiness(ctx)
+	return ret
+}
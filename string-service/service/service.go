@@ -1,16 +1,20 @@
 package service
 
 import (
+	"context"
 	"errors"
+	"gomicro-discover/health"
 	"strings"
+	"sync/atomic"
 )
 
 //service层
 
+//拼接结果的默认最大长度，可以通过SetMaxSize在运行时修改
 const StrMaxSize = 1024
 
 var (
-	ErrMaxSize  = errors.New("maximum size of 1024 bytes exceeded")
+	ErrMaxSize  = errors.New("maximum size exceeded")
 	ErrMaxValue = errors.New("maximum size of 1024 bytes exceeded")
 )
 
@@ -19,20 +23,50 @@ type Service interface {
 
 	Diff(a, b string) (string, error)
 
+	//就绪检查的整体状态不为fail时返回true
 	HealthCheck() bool
+
+	//存活检查报告，失败时应重启实例
+	Liveness(ctx context.Context) health.Report
+
+	//就绪检查报告，失败时不应再接收流量
+	Readiness(ctx context.Context) health.Report
 }
 
 type StringService struct {
+	//拼接结果的最大长度，为0时使用StrMaxSize
+	maxSize int64
+	//存活和就绪检查，为nil时始终健康
+	checks health.Checks
+}
+
+func NewStringService(checks health.Checks) *StringService {
+	return &StringService{maxSize: StrMaxSize, checks: checks}
+}
+
+//修改拼接结果的最大长度，size不大于0时恢复为StrMaxSize，可以在处理请求时并发调用
+func (s *StringService) SetMaxSize(size int) {
+	if size <= 0 {
+		size = StrMaxSize
+	}
+	atomic.StoreInt64(&s.maxSize, int64(size))
 }
 
-func (s StringService) Concat(a, b string) (string, error) {
-	if len(a)+len(b) > StrMaxSize {
+func (s *StringService) MaxSize() int {
+	if size := atomic.LoadInt64(&s.maxSize); size > 0 {
+		return int(size)
+	}
+	return StrMaxSize
+}
+
+func (s *StringService) Concat(a, b string) (string, error) {
+	if len(a)+len(b) > s.MaxSize() {
 		return "", ErrMaxSize
 	}
 	return a + b, nil
 }
 
-func (s StringService) Diff(a, b string) (string, error) {
+func (s *StringService) Diff(a, b string) (string, error) {
 	if len(a) < 1 || len(b) < 1 {
 		return "", nil
 	}
@@ -53,8 +87,16 @@ func (s StringService) Diff(a, b string) (string, error) {
 	return res, nil
 }
 
-func (s StringService) HealthCheck() bool {
-	return true
+func (s *StringService) HealthCheck() bool {
+	return s.Readiness(context.Background()).Healthy()
+}
+
+func (s *StringService) Liveness(ctx context.Context) health.Report {
+	return s.checks.Liveness.Check(ctx)
+}
+
+func (s *StringService) Readiness(ctx context.Context) health.Report {
+	return s.checks.Readiness.Check(ctx)
 }
 
 //定义服务的中间件：用于在service层注入日志记录行为
@@ -9,7 +9,9 @@ import (
 	kithttp "github.com/go-kit/kit/transport/http"
 	"github.com/gorilla/mux"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"gomicro-discover/outlier"
 	"gomicro-discover/string-service/endpoint"
+	"gomicro-discover/tracing"
 	"net/http"
 )
 
@@ -17,33 +19,56 @@ import (
 
 var ErrorBadRequest = errors.New("invalid request parameter")
 
-func MakeHttpHandler(ctx context.Context, endpoint endpoint.StringEndpoint, logger log2.Logger) http.Handler {
+func MakeHttpHandler(ctx context.Context, endpoint endpoint.StringEndpoint, detector *outlier.Detector, logger log2.Logger) http.Handler {
 	r := mux.NewRouter()
 	options := []kithttp.ServerOption{
 		kithttp.ServerErrorHandler(transport.NewLogErrorHandler(logger)),
 		kithttp.ServerErrorEncoder(encodeError),
 	}
+	//业务路由提取并写入W3C追踪上下文，span名不包含路径参数；健康检查由consul频繁调用，不追踪
+	traced := func(name string) []kithttp.ServerOption {
+		return append(tracing.ServerOptions(name), options...)
+	}
 
 	r.Methods("POST").Path("/op/{type}/{a}/{b}").Handler(kithttp.NewServer(
 		endpoint.StringEndpoint,
 		decodeStringRequest,
 		encodeStringResponse,
-		options...,
+		traced("POST /op/{type}")...,
 	))
 
 	//todo promhttp.handler
 	r.Path("/metrics").Handler(promhttp.Handler())
+	//熔断管理接口：GET返回各实例的统计信息和驱逐状态，DELETE ?instance=host:port手动恢复实例；
+	//只在调用下游服务的endpoint通过detector.Factory或balancer.WithFilter使用了Detector时传入，否则为nil
+	if detector != nil {
+		r.Path("/admin/outlier").Handler(outlier.MakeHttpHandler(detector))
+	}
 
+	//health：/health/live为存活检查，/health/ready为就绪检查，/health与就绪检查相同
 	r.Methods("GET").Path("/health").Handler(kithttp.NewServer(
 		endpoint.HealthCheckEndpoint,
-		decodeHealthCheckEndpoint,
+		decodeReadinessEndpoint,
+		encodeStringResponse,
+		options...,
+	))
+	r.Methods("GET").Path("/health/live").Handler(kithttp.NewServer(
+		endpoint.HealthCheckEndpoint,
+		decodeLivenessEndpoint,
+		encodeStringResponse,
+		options...,
+	))
+	r.Methods("GET").Path("/health/ready").Handler(kithttp.NewServer(
+		endpoint.HealthCheckEndpoint,
+		decodeReadinessEndpoint,
 		encodeStringResponse,
 		options...,
 	))
 	return r
 }
 
-func encodeError(_ context.Context, err error, w http.ResponseWriter) {
+func encodeError(ctx context.Context, err error, w http.ResponseWriter) {
+	tracing.InjectResponse(ctx, w)
 	w.Header().Set("Content-Type", "application/json;charset=utf-8")
 	switch err {
 	default:
@@ -80,9 +105,21 @@ func decodeStringRequest(_ context.Context, r *http.Request) (interface{}, error
 
 func encodeStringResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
 	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	//健康检查等响应自带状态码
+	if coder, ok := response.(kithttp.StatusCoder); ok {
+		w.WriteHeader(coder.StatusCode())
+	}
 	return json.NewEncoder(w).Encode(response)
 }
 
-func decodeHealthCheckEndpoint(ctx context.Context, r *http.Request) (interface{}, error) {
-	return endpoint.HealthRequest{}, nil
+//不同的路由对应不同类型的健康检查
+var (
+	decodeLivenessEndpoint  = decodeHealthCheckEndpoint(endpoint.ProbeLiveness)
+	decodeReadinessEndpoint = decodeHealthCheckEndpoint(endpoint.ProbeReadiness)
+)
+
+func decodeHealthCheckEndpoint(probe string) kithttp.DecodeRequestFunc {
+	return func(ctx context.Context, r *http.Request) (interface{}, error) {
+		return endpoint.HealthRequest{Probe: probe}, nil
+	}
 }
@@ -0,0 +1,92 @@
+package tracing
+
+import (
+	"context"
+	"github.com/go-kit/kit/endpoint"
+	kitlog "github.com/go-kit/kit/log"
+	kitoc "github.com/go-kit/kit/tracing/opencensus"
+	kithttp "github.com/go-kit/kit/transport/http"
+	"go.opencensus.io/plugin/ochttp/propagation/tracecontext"
+	"go.opencensus.io/trace"
+	"go.opencensus.io/trace/propagation"
+	"net/http"
+	"sort"
+)
+
+//分布式追踪：基于go-kit的opencensus中间件，HTTP请求通过W3C Trace Context（traceparent和tracestate请求头）
+//传递追踪上下文，网关等调用方不需要使用相同的追踪实现
+
+//W3C Trace Context格式
+var HTTPFormat propagation.HTTPFormat = &tracecontext.HTTPFormat{}
+
+//配置采样率并注册导出器。sampleRate为没有上游追踪上下文时的采样比例，上游已采样的请求始终采样；
+//logger不为nil时将结束的span写入日志
+func Init(sampleRate float64, logger kitlog.Logger) {
+	trace.ApplyConfig(trace.Config{DefaultSampler: trace.ProbabilitySampler(sampleRate)})
+	if logger != nil {
+		trace.RegisterExporter(&logExporter{logger: logger})
+	}
+}
+
+//kit http server的追踪选项：从请求头中提取追踪上下文并创建名为name的server span，
+//在响应头中写入本次请求的追踪上下文，调用方可以据此找到对应的追踪。name不应包含路径参数
+func ServerOptions(name string) []kithttp.ServerOption {
+	return []kithttp.ServerOption{
+		kitoc.HTTPServerTrace(kitoc.WithName(name), kitoc.WithHTTPPropagation(HTTPFormat)),
+		kithttp.ServerAfter(func(ctx context.Context, w http.ResponseWriter) context.Context {
+			InjectResponse(ctx, w)
+			return ctx
+		}),
+	}
+}
+
+//kit http client的追踪选项：创建名为name的client span，并在请求头中写入追踪上下文
+func ClientOptions(name string) []kithttp.ClientOption {
+	return []kithttp.ClientOption{
+		kitoc.HTTPClientTrace(kitoc.WithName(name), kitoc.WithHTTPPropagation(HTTPFormat)),
+	}
+}
+
+//将ctx中span的追踪上下文写入响应头，ctx中没有span时忽略。需要在写入状态码之前调用，
+//没有经过ServerAfter的错误响应需要在ErrorEncoder中调用
+func InjectResponse(ctx context.Context, w http.ResponseWriter) {
+	span := trace.FromContext(ctx)
+	if span == nil {
+		return
+	}
+	//HTTPFormat只能写入请求头，借用与响应共享的Header
+	HTTPFormat.SpanContextToRequest(span.SpanContext(), &http.Request{Header: w.Header()})
+}
+
+//为endpoint创建名为name的span，需要与ServerOptions一起使用，使span成为server span的子span
+func EndpointMiddleware(name string) endpoint.Middleware {
+	return kitoc.TraceEndpoint(name)
+}
+
+//将结束的span写入日志，用于没有部署追踪后端的环境
+type logExporter struct {
+	logger kitlog.Logger
+}
+
+func (e *logExporter) ExportSpan(s *trace.SpanData) {
+	keyvals := []interface{}{
+		"span", s.Name,
+		"trace_id", s.TraceID.String(),
+		"span_id", s.SpanID.String(),
+		"parent_span_id", s.ParentSpanID.String(),
+		"took", s.EndTime.Sub(s.StartTime),
+		"status", s.Code,
+	}
+	if s.Message != "" {
+		keyvals = append(keyvals, "message", s.Message)
+	}
+	keys := make([]string, 0, len(s.Attributes))
+	for key := range s.Attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		keyvals = append(keyvals, key, s.Attributes[key])
+	}
+	e.logger.Log(keyvals...)
+}
@@ -0,0 +1,184 @@
+package tracing_test
+
+import (
+	"context"
+	"encoding/json"
+	kitlog "github.com/go-kit/kit/log"
+	"go.opencensus.io/trace"
+	"gomicro-discover/discover"
+	"gomicro-discover/discover/discovertest"
+	"gomicro-discover/discover/discovertracing"
+	endpts "gomicro-discover/endpoint"
+	"gomicro-discover/health"
+	"gomicro-discover/service"
+	"gomicro-discover/string-service/client"
+	stringendpoint "gomicro-discover/string-service/endpoint"
+	"gomicro-discover/tracing"
+	"gomicro-discover/transport"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+//网关和string-service客户端按main中的方式组装，检查导出的span之间的父子关系以及traceparent的传递
+
+const (
+	upstreamTraceId = "4bf92f3577b34da6a3ce929d0e0e4736"
+	upstreamSpanId  = "00f067aa0ba902b7"
+)
+
+//记录导出的span
+type recordingExporter struct {
+	mutex sync.Mutex
+	spans []*trace.SpanData
+}
+
+func (e *recordingExporter) ExportSpan(s *trace.SpanData) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.spans = append(e.spans, s)
+}
+
+//按名称查找span，不存在时测试失败
+func (e *recordingExporter) span(t *testing.T, name string) *trace.SpanData {
+	t.Helper()
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	for _, s := range e.spans {
+		if s.Name == name {
+			return s
+		}
+	}
+	t.Fatalf("span %q not exported", name)
+	return nil
+}
+
+//使用与main相同的采样配置注册导出器，返回的函数取消注册
+func newExporter() (*recordingExporter, func()) {
+	tracing.Init(0, nil)
+	exporter := &recordingExporter{}
+	trace.RegisterExporter(exporter)
+	return exporter, func() { trace.UnregisterExporter(exporter) }
+}
+
+func assertParent(t *testing.T, child, parent *trace.SpanData) {
+	t.Helper()
+	if child.TraceID != parent.TraceID || child.ParentSpanID != parent.SpanID {
+		t.Fatalf("span %q has trace %s parent %s, want child of %q (trace %s span %s)",
+			child.Name, child.TraceID, child.ParentSpanID, parent.Name, parent.TraceID, parent.SpanID)
+	}
+}
+
+//上游已采样的traceparent即使采样率为0也会被追踪，服务发现的span是endpoint span的子span，
+//endpoint span是server span的子span，server span是上游span的子span
+func TestGatewayDiscoverySpans(t *testing.T) {
+	exporter, unregister := newExporter()
+	defer unregister()
+
+	discoverClient := discovertest.NewClient()
+	discoverClient.SetInstances("string", &discover.ServiceInstance{ID: "string-1", Address: "127.0.0.1", Port: 10085})
+	svc := service.NewDiscoverServiceImpl(discovertracing.NewClient(discoverClient), nil, health.Checks{})
+	endpoints := endpts.DiscoveryEndpoint{
+		DiscoveryEndpoint: tracing.EndpointMiddleware("Discovery")(endpts.MakeDiscoveryEndpoint(svc)),
+	}
+	handler := transport.MakeHttpHandler(context.Background(), endpoints, nil, kitlog.NewNopLogger())
+
+	req := httptest.NewRequest("GET", "/discovery?serviceName=string", nil)
+	req.Header.Set("traceparent", "00-"+upstreamTraceId+"-"+upstreamSpanId+"-01")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", rec.Code, rec.Body.String())
+	}
+	var resp endpts.DiscoveryResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil || len(resp.Instances) != 1 {
+		t.Fatalf("response = %+v, %v, want 1 instance", resp, err)
+	}
+
+	server := exporter.span(t, "GET /discovery")
+	if server.SpanKind != trace.SpanKindServer {
+		t.Fatalf("server span kind = %d, want server", server.SpanKind)
+	}
+	if server.TraceID.String() != upstreamTraceId || server.ParentSpanID.String() != upstreamSpanId {
+		t.Fatalf("server span has trace %s parent %s, want the upstream trace context", server.TraceID, server.ParentSpanID)
+	}
+	endpoint := exporter.span(t, "Discovery")
+	assertParent(t, endpoint, server)
+	discovery := exporter.span(t, "discover.DiscoverService")
+	assertParent(t, discovery, endpoint)
+	if discovery.SpanKind != trace.SpanKindClient {
+		t.Fatalf("discovery span kind = %d, want client", discovery.SpanKind)
+	}
+	if service := discovery.Attributes["discover.service"]; service != "string" {
+		t.Fatalf("discover.service = %v, want string", service)
+	}
+	if instances := discovery.Attributes["discover.instances"]; instances != int64(1) {
+		t.Fatalf("discover.instances = %v, want 1", instances)
+	}
+
+	//响应头中写入本次请求的追踪上下文
+	want := "00-" + upstreamTraceId + "-" + server.SpanID.String() + "-01"
+	if got := rec.Header().Get("traceparent"); got != want {
+		t.Fatalf("response traceparent = %q, want %q", got, want)
+	}
+}
+
+//调用string-service时创建client span，并在请求头中写入以client span为父span的traceparent
+func TestStringClientInjectsTraceparent(t *testing.T) {
+	exporter, unregister := newExporter()
+	defer unregister()
+
+	traceparents := make(chan string, 1)
+	stringService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case traceparents <- r.Header.Get("traceparent"):
+		default:
+		}
+		w.Write([]byte(`{"result":"ab"}`))
+	}))
+	defer stringService.Close()
+	host, port, err := net.SplitHostPort(stringService.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	portNum, _ := strconv.Atoi(port)
+	discoverClient := discovertest.NewClient()
+	discoverClient.SetInstances("string", &discover.ServiceInstance{ID: "string-1", Address: host, Port: portNum})
+	stringEndpoint, instancer, err := client.NewStringEndpoint(discoverClient, "string", kitlog.NewNopLogger(), 3, time.Second, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer instancer.Stop()
+
+	ctx, parent := trace.StartSpan(context.Background(), "caller", trace.WithSampler(trace.AlwaysSample()))
+	//实例列表由订阅异步推送，第一次推送前没有可用的endpoint
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		resp, err := stringEndpoint(ctx, stringendpoint.StringRequest{RequestType: "Concat", A: "a", B: "b"})
+		if err == nil {
+			if result := resp.(stringendpoint.StringResponse).Result; result != "ab" {
+				t.Fatalf("result = %q, want ab", result)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("call string-service: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	parent.End()
+
+	clientSpan := exporter.span(t, "POST /op/{type}")
+	if clientSpan.SpanKind != trace.SpanKindClient {
+		t.Fatalf("client span kind = %d, want client", clientSpan.SpanKind)
+	}
+	assertParent(t, clientSpan, exporter.span(t, "caller"))
+	want := "00-" + clientSpan.TraceID.String() + "-" + clientSpan.SpanID.String() + "-01"
+	if got := <-traceparents; got != want {
+		t.Fatalf("outgoing traceparent = %q, want %q", got, want)
+	}
+}
@@ -8,14 +8,20 @@ import (
 	"github.com/go-kit/kit/transport"
 	kithttp "github.com/go-kit/kit/transport/http"
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"gomicro-discover/discover"
 	endpts "gomicro-discover/endpoint"
+	"gomicro-discover/outlier"
+	"gomicro-discover/tracing"
 	"net/http"
+	"strings"
+	"time"
 )
 
 //tranport层需要声明对外暴露的HTTP服务，将endpoint包中定义的endpoint与对应的HTTP路径绑定
 var ErrorBadRequest = errors.New("invalid request parameter")
 
-func MakeHttpHandler(ctx context.Context, endpoints endpts.DiscoveryEndpoint, logger kitlog.Logger) http.Handler {
+func MakeHttpHandler(ctx context.Context, endpoints endpts.DiscoveryEndpoint, detector *outlier.Detector, logger kitlog.Logger) http.Handler {
 	r := mux.NewRouter()
 
 	//设置ServerOption
@@ -23,13 +29,17 @@ func MakeHttpHandler(ctx context.Context, endpoints endpts.DiscoveryEndpoint, lo
 		kithttp.ServerErrorHandler(transport.NewLogErrorHandler(logger)),
 		kithttp.ServerErrorEncoder(encodeError),
 	}
+	//业务路由提取并写入W3C追踪上下文，span名不包含路径参数；健康检查由consul频繁调用，不追踪
+	traced := func(name string) []kithttp.ServerOption {
+		return append(tracing.ServerOptions(name), options...)
+	}
 
 	//say-hello handler
 	r.Methods("GET").Path("/say-hello").Handler(kithttp.NewServer(
 		endpoints.SayHelloEndpoint,
 		decodeSayHelloRequest,
 		encodeJsonReponse,
-		options...,
+		traced("GET /say-hello")...,
 	))
 
 	//discovery handler
@@ -37,15 +47,41 @@ func MakeHttpHandler(ctx context.Context, endpoints endpts.DiscoveryEndpoint, lo
 		endpoints.DiscoveryEndpoint,
 		decodeDiscoveryRequest,
 		encodeJsonReponse,
-		options...,
+		traced("GET /discovery")...,
 	))
-	//health
+	//leader handler
+	r.Methods("GET").Path("/leader").Handler(kithttp.NewServer(
+		endpoints.LeaderEndpoint,
+		decodeLeaderRequest,
+		encodeJsonReponse,
+		traced("GET /leader")...,
+	))
+	//health：/health/live为存活检查，/health/ready为就绪检查，/health与就绪检查相同
 	r.Methods("GET").Path("/health").Handler(kithttp.NewServer(
 		endpoints.HealthCheckEndpoint,
-		decodeHealthCheckRequest,
+		decodeHealthCheckRequest(endpts.ProbeReadiness),
+		encodeJsonReponse,
+		options...,
+	))
+	r.Methods("GET").Path("/health/live").Handler(kithttp.NewServer(
+		endpoints.HealthCheckEndpoint,
+		decodeHealthCheckRequest(endpts.ProbeLiveness),
+		encodeJsonReponse,
+		options...,
+	))
+	r.Methods("GET").Path("/health/ready").Handler(kithttp.NewServer(
+		endpoints.HealthCheckEndpoint,
+		decodeHealthCheckRequest(endpts.ProbeReadiness),
 		encodeJsonReponse,
 		options...,
 	))
+	//prometheus指标，包括服务发现客户端的调用、缓存和监控状态
+	r.Path("/metrics").Handler(promhttp.Handler())
+	//熔断管理接口：GET返回各实例的统计信息和驱逐状态，DELETE ?instance=host:port手动恢复实例；
+	//只在调用下游服务的endpoint通过detector.Factory或balancer.WithFilter使用了Detector时传入，否则为nil
+	if detector != nil {
+		r.Path("/admin/outlier").Handler(outlier.MakeHttpHandler(detector))
+	}
 	return r
 }
 
@@ -54,34 +90,85 @@ func decodeSayHelloRequest(_ context.Context, r *http.Request) (interface{}, err
 	return endpts.SayHelloRequest{}, nil
 }
 
+//支持tag=和meta.<key>=参数对服务实例进行过滤，tag可以指定多个
+//dc=指定查询的数据中心，failover=指定没有可用实例时依次查询的数据中心，多个使用逗号分隔
+//consistency=指定一致性模式default、stale、consistent或cached，max_stale=指定stale模式下允许的最长过期时间
 func decodeDiscoveryRequest(_ context.Context, r *http.Request) (interface{}, error) {
-	serviceName := r.URL.Query().Get("serviceName")
+	query := r.URL.Query()
+	serviceName := query.Get("serviceName")
 	if serviceName == "" {
 		return nil, ErrorBadRequest
 	}
+	var meta map[string]string
+	for key, values := range query {
+		if !strings.HasPrefix(key, "meta.") || len(values) == 0 {
+			continue
+		}
+		metaKey := strings.TrimPrefix(key, "meta.")
+		if metaKey == "" {
+			return nil, ErrorBadRequest
+		}
+		if meta == nil {
+			meta = make(map[string]string)
+		}
+		meta[metaKey] = values[0]
+	}
+	var failover []string
+	for _, value := range query["failover"] {
+		failover = append(failover, discover.ParseTags(value)...)
+	}
+	consistency, err := discover.ParseConsistencyMode(query.Get("consistency"))
+	if err != nil {
+		return nil, ErrorBadRequest
+	}
+	var maxStale time.Duration
+	if value := query.Get("max_stale"); value != "" {
+		if maxStale, err = time.ParseDuration(value); err != nil || maxStale < 0 {
+			return nil, ErrorBadRequest
+		}
+	}
 	return endpts.DiscoveryRequest{
 		ServiceName: serviceName,
+		Tags:        query["tag"],
+		Meta:        meta,
+		Datacenter:  query.Get("dc"),
+		Failover:    failover,
+		Consistency: consistency,
+		MaxStale:    maxStale,
 	}, nil
 }
 
-func decodeHealthCheckRequest(ctx context.Context, r *http.Request) (interface{}, error) {
+//serviceName=指定查询leader的服务
+func decodeLeaderRequest(_ context.Context, r *http.Request) (interface{}, error) {
 	serviceName := r.URL.Query().Get("serviceName")
 	if serviceName == "" {
 		return nil, ErrorBadRequest
 	}
-	return endpts.DiscoveryRequest{
+	return endpts.LeaderRequest{
 		ServiceName: serviceName,
 	}, nil
 }
 
+//不同的路由对应不同类型的健康检查
+func decodeHealthCheckRequest(probe string) kithttp.DecodeRequestFunc {
+	return func(ctx context.Context, r *http.Request) (interface{}, error) {
+		return endpts.HealthRequest{Probe: probe}, nil
+	}
+}
+
 func encodeJsonReponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
 	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	//健康检查等响应自带状态码
+	if coder, ok := response.(kithttp.StatusCoder); ok {
+		w.WriteHeader(coder.StatusCode())
+	}
 
 	//todo json.NewEncoder 这里的处理逻辑是怎样的
 	return json.NewEncoder(w).Encode(response)
 }
 
-func encodeError(_ context.Context, err error, w http.ResponseWriter) {
+func encodeError(ctx context.Context, err error, w http.ResponseWriter) {
+	tracing.InjectResponse(ctx, w)
 	w.Header().Set("Content-Type", "application/josn;charset=utf-8")
 	switch err {
 	default: